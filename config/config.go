@@ -1,32 +1,418 @@
 package config
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/vinit-chauhan/load-balancer/logger"
 	"gopkg.in/yaml.v3"
 )
 
 var (
-	config = ConfigType{}
+	config    = ConfigType{}
+	configMux sync.RWMutex
+
+	// content is the config file as last loaded or saved, to tell real changes of the
+	// file from the writes of Save.
+	content    []byte
+	contentMux sync.Mutex
 )
 
 type ConfigType struct {
-	Services []ServiceType `yaml:"services"`
+	Listener       ListenerConfig       `yaml:"listener,omitempty"`
+	RateLimitStore RateLimitStoreConfig `yaml:"rate_limit_store,omitempty"`
+	HealthChecks   HealthChecksConfig   `yaml:"health_checks,omitempty"`
+	Admin          AdminConfig          `yaml:"admin,omitempty"`
+	Services       []ServiceType        `yaml:"services,omitempty"`
+	TCPServices    []TCPServiceType     `yaml:"tcp_services,omitempty"`
+	UDPServices    []UDPServiceType     `yaml:"udp_services,omitempty"`
+}
+
+// ListenerConfig configures the main HTTP listener.
+type ListenerConfig struct {
+	UnixSocket    string              `yaml:"unix_socket,omitempty"` // Listen on this socket path instead of PORT
+	ProxyProtocol ProxyProtocolConfig `yaml:"proxy_protocol,omitempty"`
+	// Server timeouts (durations, empty means no timeout). WriteTimeout also bounds
+	// streaming responses, so leave it empty when serving SSE or gRPC streams.
+	ReadTimeout       string `yaml:"read_timeout,omitempty"`
+	ReadHeaderTimeout string `yaml:"read_header_timeout,omitempty"`
+	WriteTimeout      string `yaml:"write_timeout,omitempty"`
+	IdleTimeout       string `yaml:"idle_timeout,omitempty"`
+}
+
+// RateLimitStoreConfig selects where the rate limits of all services are counted:
+// "memory" (default) counts them in each process, "redis" shares them between
+// every load balancer using the same Redis server.
+type RateLimitStoreConfig struct {
+	Type  string      `yaml:"type,omitempty"`
+	Redis RedisConfig `yaml:"redis,omitempty"`
+}
+
+// AdminConfig configures the admin API, served on its own listener at Listen (default
+// "127.0.0.1:9090", so only local clients reach it). Requests must carry the header
+// "Authorization: Bearer <Token>". The admin listener is not changed by config reloads.
+// With Persist, services and backends changed through the API are written back to the
+// config file, comments and defaults left out.
+type AdminConfig struct {
+	Enabled bool   `yaml:"enabled,omitempty"`
+	Listen  string `yaml:"listen,omitempty"`
+	Token   string `yaml:"token,omitempty"`
+	Persist bool   `yaml:"persist,omitempty"`
+}
+
+// Validate checks the admin API settings, and fills in the defaults.
+func (a *AdminConfig) Validate() {
+	if !a.Enabled {
+		return
+	}
+	if a.Token == "" {
+		logger.Error("Validate", "error admin API needs a token")
+		panic("validation error: Admin: token")
+	}
+	if a.Listen == "" {
+		a.Listen = "127.0.0.1:9090"
+	}
+}
+
+// HealthChecksConfig applies to the health checks of all services. Backends are checked
+// concurrently, up to MaxConcurrent checks at a time (default 64).
+type HealthChecksConfig struct {
+	MaxConcurrent int `yaml:"max_concurrent,omitempty"`
+}
+
+// Validate checks the global health check settings.
+func (h *HealthChecksConfig) Validate() {
+	if h.MaxConcurrent < 0 {
+		logger.Error("Validate", "error health_checks max_concurrent cannot be negative")
+		panic("validation error: HealthChecks: max_concurrent: " + strconv.Itoa(h.MaxConcurrent))
+	}
+}
+
+// RedisConfig locates the Redis server of the "redis" rate limit store.
+type RedisConfig struct {
+	Address   string `yaml:"address,omitempty"` // e.g. "redis:6379"
+	Password  string `yaml:"password,omitempty"`
+	DB        int    `yaml:"db,omitempty"`
+	Timeout   string `yaml:"timeout,omitempty"`    // Per command, default 100ms; requests are allowed when it expires
+	KeyPrefix string `yaml:"key_prefix,omitempty"` // Default "lb:ratelimit:"
+}
+
+// Validate checks the rate limit store settings.
+func (s *RateLimitStoreConfig) Validate() {
+	switch s.Type {
+	case "", "memory":
+	case "redis":
+		if s.Redis.Address == "" {
+			logger.Error("Validate", "error redis rate limit store needs an address")
+			panic("validation error: RateLimitStore: redis address")
+		}
+		if s.Redis.Timeout != "" {
+			if d, err := time.ParseDuration(s.Redis.Timeout); err != nil || d <= 0 {
+				logger.Error("Validate", "error invalid redis timeout", "value", s.Redis.Timeout)
+				panic("validation error: RateLimitStore: redis timeout: " + s.Redis.Timeout)
+			}
+		}
+	default:
+		logger.Error("Validate", "error unknown rate limit store", "type", s.Type)
+		panic("validation error: RateLimitStore: " + s.Type)
+	}
+}
+
+// ProxyProtocolConfig enables accepting PROXY protocol (v1 or v2) headers on a listener.
+// Connections from TrustedCIDRs must start with a header, which then provides the client
+// address; other connections are served as they are. Enabling it requires TrustedCIDRs.
+type ProxyProtocolConfig struct {
+	Enabled      bool     `yaml:"enabled,omitempty"`
+	TrustedCIDRs []string `yaml:"trusted_cidrs,omitempty"`
 }
 
 type ServiceType struct {
-	Name        string            `yaml:"name"`
-	Backends    []string          `yaml:"urls"`
-	UrlPath     string            `yaml:"endpoint"`
-	Algorithm   string            `yaml:"algorithm"`    // "round-robin", "least-connections", "ip-hash"
-	HealthCheck HealthCheckConfig `yaml:"health_check"`
+	Name        string            `yaml:"name,omitempty"`
+	Backends    []string          `yaml:"urls,omitempty"` // e.g. "http://host:port", or "unix:///run/app.sock[:/path/prefix]"
+	UrlPath     string            `yaml:"endpoint,omitempty"`
+	Algorithm   string            `yaml:"algorithm,omitempty"` // "round-robin", "least-connections", "ip-hash"
+	Protocol    string            `yaml:"protocol,omitempty"`  // "http" (default), "grpc"
+	HealthCheck HealthCheckConfig `yaml:"health_check,omitempty"`
+	WebSocket   WebSocketConfig   `yaml:"websocket,omitempty"`
+	// How often to flush response bodies to the client: a duration, or "immediate"
+	// to flush after every write. By default, SSE and responses of unknown length
+	// are flushed immediately and others are buffered.
+	FlushInterval  string         `yaml:"flush_interval,omitempty"`
+	Timeouts       TimeoutsConfig `yaml:"timeouts,omitempty"`
+	ConnectionPool PoolConfig     `yaml:"connection_pool,omitempty"`
+	CircuitBreaker BreakerConfig  `yaml:"circuit_breaker,omitempty"`
+	// Concurrency limits. MaxConnections caps the requests in flight to each backend
+	// (upgraded connections excluded); once every backend is at the cap, up to
+	// MaxPending requests wait for up to QueueTimeout (default 1s), in arrival order,
+	// and the others get a 503 with Retry-After. 0 means no limit / no queue.
+	MaxConnections int    `yaml:"max_connections,omitempty"`
+	MaxPending     int    `yaml:"max_pending,omitempty"`
+	QueueTimeout   string `yaml:"queue_timeout,omitempty"`
+	// Rate limits; a request must be allowed by all of them.
+	RateLimits          []RateLimitConfig         `yaml:"rate_limits,omitempty"`
+	AdaptiveConcurrency AdaptiveConcurrencyConfig `yaml:"adaptive_concurrency,omitempty"`
+	Hedging             HedgingConfig             `yaml:"hedging,omitempty"`
+	Retries             RetryConfig               `yaml:"retries,omitempty"`
+	// Relative share of the traffic of backends, keyed by their URL as listed in urls
+	// (default 1, at most 100).
+	Weights map[string]int `yaml:"weights,omitempty"`
+	// When fewer than PanicThreshold percent of the backends pass health checks, health
+	// checks are ignored and traffic goes to all backends. 0 (default) disables it.
+	PanicThreshold float64 `yaml:"panic_threshold,omitempty"`
+	// Faults injected into requests, for testing clients in staging. A request gets
+	// the first fault it matches.
+	Faults []FaultConfig `yaml:"faults,omitempty"`
+}
+
+// FaultConfig injects a fault into the requests carrying Header, Percentage of them
+// (default 100 with a header), or Percentage of all requests without one. Matched requests
+// are delayed by Delay, or a random duration between Delay and MaxDelay, then answered
+// with AbortStatus (gRPC services answer UNAVAILABLE), or get their connection reset.
+type FaultConfig struct {
+	Name        string  `yaml:"name,omitempty"`   // Used in metrics, defaults to "fault-<index>"
+	Header      string  `yaml:"header,omitempty"` // "<Name>", or "<Name>: <value>" to also match the value
+	Percentage  float64 `yaml:"percentage,omitempty"`
+	Delay       string  `yaml:"delay,omitempty"`
+	MaxDelay    string  `yaml:"max_delay,omitempty"`
+	AbortStatus int     `yaml:"abort_status,omitempty"`
+	Reset       bool    `yaml:"reset,omitempty"`
+}
+
+// RetryConfig retries idempotent requests without a body on another backend, up to
+// Attempts times, when the backend cannot be reached or answers with one of Statuses
+// (default 502, 503 and 504). Retries are capped by a budget shared by the requests of
+// the service: BudgetPercent (default 20) of the successful requests over BudgetWindow
+// (default 10s), plus MinPerSecond, so retries stop when most requests fail.
+type RetryConfig struct {
+	Attempts      int     `yaml:"attempts,omitempty"`
+	Statuses      []int   `yaml:"statuses,omitempty"`
+	BudgetPercent float64 `yaml:"budget_percent,omitempty"`
+	MinPerSecond  float64 `yaml:"min_per_second,omitempty"`
+	BudgetWindow  string  `yaml:"budget_window,omitempty"`
 }
 
+// HedgingConfig sends a second copy of GET requests that have no response headers after
+// Delay to another backend, and uses the first response. Delay is a duration, or "p95" to
+// follow the 95th percentile of the response header latency. Hedges are capped at
+// BudgetPercent of the requests (default 10).
+type HedgingConfig struct {
+	Enabled       bool    `yaml:"enabled,omitempty"`
+	Delay         string  `yaml:"delay,omitempty"`
+	BudgetPercent float64 `yaml:"budget_percent,omitempty"`
+}
+
+// AdaptiveConcurrencyConfig caps the requests in flight to a service at a limit that
+// follows the observed latency, shedding the excess with 503. "gradient" compares recent
+// latency with its baseline; "aimd" backs off when latency exceeds LatencyThreshold or
+// requests fail, and grows by one otherwise.
+//
+// With PriorityHeader set, requests are classed by the header value among PriorityClasses
+// (highest first, unknown values get the last class), and lower classes are shed first.
+type AdaptiveConcurrencyConfig struct {
+	Enabled          bool     `yaml:"enabled,omitempty"`
+	Algorithm        string   `yaml:"algorithm,omitempty"`         // "gradient" (default) or "aimd"
+	InitialLimit     int      `yaml:"initial_limit,omitempty"`     // Default 20
+	MinLimit         int      `yaml:"min_limit,omitempty"`         // Default 1
+	MaxLimit         int      `yaml:"max_limit,omitempty"`         // Default 1000
+	LatencyThreshold string   `yaml:"latency_threshold,omitempty"` // aimd only, default 1s
+	PriorityHeader   string   `yaml:"priority_header,omitempty"`
+	PriorityClasses  []string `yaml:"priority_classes,omitempty"`
+}
+
+// RateLimitConfig limits the requests of a service to Limit per Window, counted per Key.
+// Token buckets allow bursts of up to Burst requests (default Limit), sliding windows
+// allow Limit requests over any Window.
+type RateLimitConfig struct {
+	Name      string `yaml:"name,omitempty"`      // Used in metrics, defaults to "rule-<index>"
+	Key       string `yaml:"key,omitempty"`       // "ip" (default), "header:<Name>" (e.g. an API key) or "route"
+	Algorithm string `yaml:"algorithm,omitempty"` // "token-bucket" (default) or "sliding-window"
+	Limit     int    `yaml:"limit,omitempty"`
+	Window    string `yaml:"window,omitempty"` // Default 1s
+	Burst     int    `yaml:"burst,omitempty"`
+}
+
+// BreakerConfig configures the circuit breaker of each backend of a service. A circuit
+// opens when, over Window and with at least MinRequests requests, the share of failed
+// requests (5xx, or failing gRPC statuses) reaches ErrorRate, or the share of requests
+// slower than SlowCallDuration reaches SlowCallRate. After OpenDuration, HalfOpenRequests
+// probes are let through, and the circuit closes again if they all succeed.
+type BreakerConfig struct {
+	Enabled          bool    `yaml:"enabled,omitempty"`
+	Window           string  `yaml:"window,omitempty"`             // Default 10s
+	MinRequests      int     `yaml:"min_requests,omitempty"`       // Default 20
+	ErrorRate        float64 `yaml:"error_rate,omitempty"`         // 0-1, default 0.5
+	SlowCallDuration string  `yaml:"slow_call_duration,omitempty"` // Empty ignores latency
+	SlowCallRate     float64 `yaml:"slow_call_rate,omitempty"`     // 0-1, default 0.5
+	OpenDuration     string  `yaml:"open_duration,omitempty"`      // Default 30s
+	HalfOpenRequests int     `yaml:"half_open_requests,omitempty"` // Default 3
+}
+
+// PoolConfig tunes the connection pool kept to each backend of a service. Zero values
+// keep the defaults: 100 idle connections, no limit on connections, 30s TCP keep-alive.
+// Idle connections are closed after timeouts.idle_conn.
+type PoolConfig struct {
+	MaxIdleConns       int    `yaml:"max_idle_conns,omitempty"`
+	MaxConnsPerHost    int    `yaml:"max_conns_per_host,omitempty"`
+	KeepAlive          string `yaml:"keep_alive,omitempty"`          // TCP keep-alive probe interval, "-1s" disables probes
+	DisableKeepAlives  bool   `yaml:"disable_keep_alives,omitempty"` // Use a new connection for every request
+	DisableCompression bool   `yaml:"disable_compression,omitempty"` // Do not ask backends for gzip responses
+}
+
+// TimeoutsConfig bounds the phases of the requests sent to the backends of a service.
+// Values are durations; empty values keep the defaults (no limit for ResponseHeader
+// and Request). Request does not apply to upgraded connections and SSE streams.
+type TimeoutsConfig struct {
+	Dial           string `yaml:"dial,omitempty"`
+	TLSHandshake   string `yaml:"tls_handshake,omitempty"`
+	ResponseHeader string `yaml:"response_header,omitempty"`
+	Request        string `yaml:"request,omitempty"`   // The whole request, response body included
+	IdleConn       string `yaml:"idle_conn,omitempty"` // Close idle upstream connections after this long
+}
+
+// HealthCheckConfig configures the active health checks of the backends of a service.
+// Type selects how backends are checked: "http" requests, "tcp" connections, "grpc"
+// calls to grpc.health.v1.Health/Check for Service, or "exec" to run Command with the
+// backend in BACKEND_URL, BACKEND_HOST and BACKEND_PORT, where exit status 0 is healthy.
+//
+// HTTP checks send Method (by default HEAD, then GET if HEAD fails) to Path with the
+// extra Headers and Host, through the transport (and TLS settings) of the backend.
+// A backend is healthy when it answers within Timeout (default 2s) with one of the
+// ExpectedStatus codes or ranges (default "200-499"), and a body matching BodyContains
+// and BodyRegex, if set. Port sends the checks to another port than the traffic.
+//
+// A backend goes down after UnhealthyThreshold consecutive failed checks (default 3),
+// and back up after HealthyThreshold consecutive successful ones (default 2). Checks
+// run every Interval (default 10s), or UnhealthyInterval while the backend is down,
+// plus a random delay of up to Jitter (default a tenth of the interval), so that the
+// checks of many backends do not run in lockstep.
 type HealthCheckConfig struct {
-	Enabled  bool   `yaml:"enabled"`
-	Interval string `yaml:"interval"`
-	Path     string `yaml:"path"`
+	Enabled            bool              `yaml:"enabled,omitempty"`
+	Type               string            `yaml:"type,omitempty"`    // "http", "tcp", "grpc" or "exec", default the protocol of the service
+	Command            []string          `yaml:"command,omitempty"` // exec: program and arguments, not run through a shell
+	Interval           string            `yaml:"interval,omitempty"`
+	UnhealthyInterval  string            `yaml:"unhealthy_interval,omitempty"`
+	Jitter             string            `yaml:"jitter,omitempty"`
+	HealthyThreshold   int               `yaml:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int               `yaml:"unhealthy_threshold,omitempty"`
+	Path               string            `yaml:"path,omitempty"`
+	Service            string            `yaml:"service,omitempty"` // gRPC health service name, empty checks the whole server
+	Method             string            `yaml:"method,omitempty"`
+	ExpectedStatus     []string          `yaml:"expected_status,omitempty"` // e.g. ["200", "300-399"]
+	BodyContains       string            `yaml:"body_contains,omitempty"`
+	BodyRegex          string            `yaml:"body_regex,omitempty"`
+	Headers            map[string]string `yaml:"headers,omitempty"`
+	Host               string            `yaml:"host,omitempty"`
+	Timeout            string            `yaml:"timeout,omitempty"`
+	Port               int               `yaml:"port,omitempty"` // Checked instead of the traffic port, by every check type; unused for Unix socket backends
+}
+
+// Validate checks the health check settings of the named service.
+func (h *HealthCheckConfig) Validate(service string) {
+	switch h.Type {
+	case "", "http", "tcp", "grpc":
+	case "exec":
+		if len(h.Command) == 0 {
+			logger.Error("Validate", "error exec health_check needs a command", "service", service)
+			panic("validation error: HealthCheck: command: " + service)
+		}
+	default:
+		logger.Error("Validate", "error health_check type must be 'http', 'tcp', 'grpc' or 'exec'", "service", service)
+		panic("validation error: HealthCheck: type: " + h.Type)
+	}
+	for _, status := range h.ExpectedStatus {
+		if _, _, ok := ParseStatusRange(status); !ok {
+			logger.Error("Validate", "error health_check expected_status must be codes or ranges like '200-299'", "service", service)
+			panic("validation error: HealthCheck: expected_status: " + status)
+		}
+	}
+	if h.BodyRegex != "" {
+		if _, err := regexp.Compile(h.BodyRegex); err != nil {
+			logger.Error("Validate", "error invalid health_check body_regex", "service", service, "error", err)
+			panic("validation error: HealthCheck: body_regex: " + h.BodyRegex)
+		}
+	}
+	if strings.EqualFold(h.Method, "HEAD") && (h.BodyContains != "" || h.BodyRegex != "") {
+		logger.Error("Validate", "error health_check body match needs a method with a response body", "service", service)
+		panic("validation error: HealthCheck: method: " + h.Method)
+	}
+	for name, value := range map[string]string{
+		"timeout":            h.Timeout,
+		"unhealthy_interval": h.UnhealthyInterval,
+		"jitter":             h.Jitter,
+	} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			logger.Error("Validate", "error invalid health_check "+name, "service", service)
+			panic("validation error: HealthCheck: " + name + ": " + value)
+		}
+	}
+	if h.HealthyThreshold < 0 || h.UnhealthyThreshold < 0 {
+		logger.Error("Validate", "error health_check thresholds cannot be negative", "service", service)
+		panic("validation error: HealthCheck: thresholds")
+	}
+	if h.Port < 0 || h.Port > 65535 {
+		logger.Error("Validate", "error invalid health_check port", "service", service)
+		panic("validation error: HealthCheck: port: " + strconv.Itoa(h.Port))
+	}
+}
+
+// ParseStatusRange parses an HTTP status code ("200") or an inclusive range of codes
+// ("200-299").
+func ParseStatusRange(s string) (lo, hi int, ok bool) {
+	from, to, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	if !isRange {
+		to = from
+	}
+	lo, err1 := strconv.Atoi(strings.TrimSpace(from))
+	hi, err2 := strconv.Atoi(strings.TrimSpace(to))
+	if err1 != nil || err2 != nil || lo < 100 || hi > 599 || lo > hi {
+		return 0, 0, false
+	}
+	return lo, hi, true
+}
+
+// TCPServiceType describes a layer-4 service: connections accepted on Listen are
+// relayed as raw byte streams to one of the backends.
+type TCPServiceType struct {
+	Name        string            `yaml:"name,omitempty"`
+	Listen      string            `yaml:"listen,omitempty"` // e.g. ":5432"
+	Backends    []string          `yaml:"urls,omitempty"`   // "host:port" or "tcp://host:port"
+	Algorithm   string            `yaml:"algorithm,omitempty"`
+	HealthCheck HealthCheckConfig `yaml:"health_check,omitempty"` // Connect-only probe, unless type is "exec"
+	IdleTimeout string            `yaml:"idle_timeout,omitempty"` // Close connections without traffic for this long
+	// Accept PROXY protocol headers from clients, and send them to backends ("v1" or "v2").
+	ProxyProtocol     ProxyProtocolConfig `yaml:"proxy_protocol,omitempty"`
+	SendProxyProtocol string              `yaml:"send_proxy_protocol,omitempty"`
+}
+
+// UDPServiceType describes a UDP service: datagrams received on Listen are forwarded
+// to one of the backends, and replies are sent back to the client that sent them.
+type UDPServiceType struct {
+	Name           string   `yaml:"name,omitempty"`
+	Listen         string   `yaml:"listen,omitempty"` // e.g. ":53"
+	Backends       []string `yaml:"urls,omitempty"`   // "host:port" or "udp://host:port"
+	Algorithm      string   `yaml:"algorithm,omitempty"`
+	SessionTimeout string   `yaml:"session_timeout,omitempty"` // Forget client flows idle for this long (default 30s)
+}
+
+// WebSocketConfig limits the lifetime of upgraded (e.g. WebSocket) connections.
+// Empty values mean no limit.
+type WebSocketConfig struct {
+	IdleTimeout string `yaml:"idle_timeout,omitempty"`
+	MaxLifetime string `yaml:"max_lifetime,omitempty"`
 }
 
 func Load(path string) {
@@ -38,18 +424,396 @@ func Load(path string) {
 	if err := yaml.Unmarshal(buff, &config); err != nil {
 		logger.Panic("Load", "Error unmarshaling config file", "error", err)
 	}
+	setContent(buff)
 }
 
 func (s *ServiceType) Validate() {
-	if s.UrlPath[0] != '/' {
+	if !strings.HasPrefix(s.UrlPath, "/") {
 		logger.Error("Validate", "error URLPath must start with '/'")
 		panic("validation error: URLPath: " + s.UrlPath)
 	}
+	if len(s.Backends) == 0 {
+		logger.Error("Validate", "error service needs at least one url", "service", s.Name)
+		panic("validation error: URLs: " + s.Name)
+	}
+	for _, backend := range s.Backends {
+		if !validBackendURL(backend) {
+			logger.Error("Validate", "error url must be 'http://host[:port]', 'https://host[:port]' or 'unix:///path/to.sock[:/prefix]'", "service", s.Name, "url", backend)
+			panic("validation error: URLs: " + backend)
+		}
+	}
 	if s.Algorithm == "" {
 		s.Algorithm = "round-robin"
 	}
+	if s.Protocol == "" {
+		s.Protocol = "http"
+	}
+	s.HealthCheck.Validate(s.Name)
+	for name, value := range map[string]string{
+		"dial":            s.Timeouts.Dial,
+		"tls_handshake":   s.Timeouts.TLSHandshake,
+		"response_header": s.Timeouts.ResponseHeader,
+		"request":         s.Timeouts.Request,
+		"idle_conn":       s.Timeouts.IdleConn,
+		"queue_timeout":   s.QueueTimeout,
+	} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(value); err != nil {
+			logger.Error("Validate", "error invalid timeout", "service", s.Name, "timeout", name, "value", value)
+			panic("validation error: Timeouts: " + name + ": " + value)
+		}
+	}
+	if s.ConnectionPool.KeepAlive != "" {
+		if _, err := time.ParseDuration(s.ConnectionPool.KeepAlive); err != nil {
+			logger.Error("Validate", "error invalid connection_pool keep_alive", "service", s.Name, "value", s.ConnectionPool.KeepAlive)
+			panic("validation error: ConnectionPool: keep_alive: " + s.ConnectionPool.KeepAlive)
+		}
+	}
+	for name, value := range map[string]string{
+		"window":             s.CircuitBreaker.Window,
+		"slow_call_duration": s.CircuitBreaker.SlowCallDuration,
+		"open_duration":      s.CircuitBreaker.OpenDuration,
+	} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			logger.Error("Validate", "error invalid circuit_breaker duration", "service", s.Name, "setting", name, "value", value)
+			panic("validation error: CircuitBreaker: " + name + ": " + value)
+		}
+	}
+	if s.CircuitBreaker.ErrorRate > 1 || s.CircuitBreaker.SlowCallRate > 1 {
+		logger.Error("Validate", "error circuit_breaker rates must be between 0 and 1", "service", s.Name)
+		panic("validation error: CircuitBreaker: rate")
+	}
+	if s.MaxConnections < 0 || s.MaxPending < 0 {
+		logger.Error("Validate", "error max_connections and max_pending cannot be negative", "service", s.Name)
+		panic("validation error: MaxConnections/MaxPending: " + s.Name)
+	}
+	for _, rl := range s.RateLimits {
+		if rl.Limit <= 0 {
+			logger.Error("Validate", "error rate limit must be positive", "service", s.Name, "rule", rl.Name)
+			panic("validation error: RateLimits: limit: " + rl.Name)
+		}
+		if rl.Key != "" && rl.Key != "ip" && rl.Key != "route" && !strings.HasPrefix(rl.Key, "header:") {
+			logger.Error("Validate", "error rate limit key must be 'ip', 'route' or 'header:<Name>'", "service", s.Name, "rule", rl.Name)
+			panic("validation error: RateLimits: key: " + rl.Key)
+		}
+		if rl.Algorithm != "" && rl.Algorithm != "token-bucket" && rl.Algorithm != "sliding-window" {
+			logger.Error("Validate", "error rate limit algorithm must be 'token-bucket' or 'sliding-window'", "service", s.Name, "rule", rl.Name)
+			panic("validation error: RateLimits: algorithm: " + rl.Algorithm)
+		}
+		if rl.Window != "" {
+			if d, err := time.ParseDuration(rl.Window); err != nil || d <= 0 {
+				logger.Error("Validate", "error invalid rate limit window", "service", s.Name, "rule", rl.Name)
+				panic("validation error: RateLimits: window: " + rl.Window)
+			}
+		}
+	}
+	if ac := s.AdaptiveConcurrency; ac.Enabled {
+		if ac.Algorithm != "" && ac.Algorithm != "gradient" && ac.Algorithm != "aimd" {
+			logger.Error("Validate", "error adaptive_concurrency algorithm must be 'gradient' or 'aimd'", "service", s.Name)
+			panic("validation error: AdaptiveConcurrency: algorithm: " + ac.Algorithm)
+		}
+		if ac.MaxLimit > 0 && ac.MinLimit > ac.MaxLimit {
+			logger.Error("Validate", "error adaptive_concurrency min_limit is above max_limit", "service", s.Name)
+			panic("validation error: AdaptiveConcurrency: min_limit > max_limit")
+		}
+		if ac.LatencyThreshold != "" {
+			if d, err := time.ParseDuration(ac.LatencyThreshold); err != nil || d <= 0 {
+				logger.Error("Validate", "error invalid adaptive_concurrency latency_threshold", "service", s.Name)
+				panic("validation error: AdaptiveConcurrency: latency_threshold: " + ac.LatencyThreshold)
+			}
+		}
+	}
+	if h := s.Hedging; h.Enabled && h.Delay != "p95" {
+		if d, err := time.ParseDuration(h.Delay); err != nil || d <= 0 {
+			logger.Error("Validate", "error hedging delay must be a duration or 'p95'", "service", s.Name)
+			panic("validation error: Hedging: delay: " + h.Delay)
+		}
+	}
+	if r := s.Retries; r.Attempts < 0 || r.BudgetPercent < 0 || r.MinPerSecond < 0 {
+		logger.Error("Validate", "error retries settings must not be negative", "service", s.Name)
+		panic("validation error: Retries: negative value")
+	}
+	for _, status := range s.Retries.Statuses {
+		if status < 100 || status > 599 {
+			logger.Error("Validate", "error invalid retries status", "service", s.Name, "status", status)
+			panic("validation error: Retries: status: " + strconv.Itoa(status))
+		}
+	}
+	if w := s.Retries.BudgetWindow; w != "" {
+		if d, err := time.ParseDuration(w); err != nil || d <= 0 {
+			logger.Error("Validate", "error invalid retries budget_window", "service", s.Name)
+			panic("validation error: Retries: budget_window: " + w)
+		}
+	}
+	for backend, weight := range s.Weights {
+		if !slices.Contains(s.Backends, backend) {
+			logger.Error("Validate", "error weight set for a backend that is not in urls", "service", s.Name, "backend", backend)
+			panic("validation error: Weights: " + backend)
+		}
+		if weight < 1 || weight > 100 {
+			logger.Error("Validate", "error weight must be between 1 and 100", "service", s.Name, "backend", backend)
+			panic("validation error: Weights: " + backend + ": " + strconv.Itoa(weight))
+		}
+	}
+	if s.PanicThreshold < 0 || s.PanicThreshold > 100 {
+		logger.Error("Validate", "error panic_threshold must be a percentage between 0 and 100", "service", s.Name)
+		panic("validation error: PanicThreshold: " + strconv.FormatFloat(s.PanicThreshold, 'f', -1, 64))
+	}
+	for _, f := range s.Faults {
+		if (f.Header == "" && f.Percentage <= 0) || f.Percentage < 0 || f.Percentage > 100 {
+			logger.Error("Validate", "error fault must match a header or a percentage between 0 and 100", "service", s.Name, "fault", f.Name)
+			panic("validation error: Faults: match: " + f.Name)
+		}
+		if (f.Delay == "" && f.AbortStatus == 0 && !f.Reset) || (f.AbortStatus != 0 && f.Reset) {
+			logger.Error("Validate", "error fault must delay, and/or either abort or reset", "service", s.Name, "fault", f.Name)
+			panic("validation error: Faults: action: " + f.Name)
+		}
+		if f.AbortStatus != 0 && (f.AbortStatus < 100 || f.AbortStatus > 599) {
+			logger.Error("Validate", "error invalid fault abort_status", "service", s.Name, "fault", f.Name)
+			panic("validation error: Faults: abort_status: " + strconv.Itoa(f.AbortStatus))
+		}
+		for name, value := range map[string]string{"delay": f.Delay, "max_delay": f.MaxDelay} {
+			if value == "" {
+				continue
+			}
+			if d, err := time.ParseDuration(value); err != nil || d < 0 {
+				logger.Error("Validate", "error invalid fault "+name, "service", s.Name, "fault", f.Name)
+				panic("validation error: Faults: " + name + ": " + value)
+			}
+		}
+		if f.MaxDelay != "" && f.Delay == "" {
+			logger.Error("Validate", "error fault max_delay needs a delay", "service", s.Name, "fault", f.Name)
+			panic("validation error: Faults: max_delay: " + f.Name)
+		}
+	}
+	if s.FlushInterval != "" && s.FlushInterval != "immediate" {
+		if _, err := time.ParseDuration(s.FlushInterval); err != nil {
+			logger.Error("Validate", "error flush_interval must be a duration or 'immediate'", "service", s.Name)
+			panic("validation error: FlushInterval: " + s.FlushInterval)
+		}
+	}
+	switch s.Protocol {
+	case "http":
+	case "grpc":
+		// gRPC calls are routed on "/package.Service/Method", so the endpoint must
+		// name a fully qualified service, optionally narrowed down to one method.
+		parts := strings.Split(s.UrlPath[1:], "/")
+		if len(parts) != 2 || !strings.Contains(parts[0], ".") {
+			logger.Error("Validate", "error gRPC endpoint must be '/package.Service/' or '/package.Service/Method'")
+			panic("validation error: URLPath: " + s.UrlPath)
+		}
+	default:
+		logger.Error("Validate", "error unknown protocol", "protocol", s.Protocol)
+		panic("validation error: Protocol: " + s.Protocol)
+	}
+}
+
+func (s *TCPServiceType) Validate() {
+	if s.Listen == "" {
+		logger.Error("Validate", "error TCP service listen address cannot be empty", "service", s.Name)
+		panic("validation error: Listen: " + s.Name)
+	}
+	if len(s.Backends) == 0 {
+		logger.Error("Validate", "error TCP service needs at least one url", "service", s.Name)
+		panic("validation error: URLs: " + s.Name)
+	}
+	for _, backend := range s.Backends {
+		if !validBackendAddress(backend, "tcp") {
+			logger.Error("Validate", "error TCP service url must be 'host:port' or 'tcp://host:port'", "service", s.Name, "url", backend)
+			panic("validation error: URLs: " + backend)
+		}
+	}
+	s.HealthCheck.Validate(s.Name)
+	if t := s.HealthCheck.Type; t != "" && t != "tcp" && t != "exec" {
+		logger.Error("Validate", "error TCP service health_check type must be 'tcp' or 'exec'", "service", s.Name)
+		panic("validation error: HealthCheck: type: " + t)
+	}
+	if s.ProxyProtocol.Enabled && len(s.ProxyProtocol.TrustedCIDRs) == 0 {
+		logger.Error("Validate", "error proxy_protocol needs trusted_cidrs", "service", s.Name)
+		panic("validation error: ProxyProtocol: " + s.Name)
+	}
+	if s.SendProxyProtocol != "" && s.SendProxyProtocol != "v1" && s.SendProxyProtocol != "v2" {
+		logger.Error("Validate", "error send_proxy_protocol must be 'v1' or 'v2'", "service", s.Name)
+		panic("validation error: SendProxyProtocol: " + s.SendProxyProtocol)
+	}
+	if s.Algorithm == "" {
+		s.Algorithm = "round-robin"
+	}
+}
+
+func (s *UDPServiceType) Validate() {
+	if s.Listen == "" {
+		logger.Error("Validate", "error UDP service listen address cannot be empty", "service", s.Name)
+		panic("validation error: Listen: " + s.Name)
+	}
+	if len(s.Backends) == 0 {
+		logger.Error("Validate", "error UDP service needs at least one url", "service", s.Name)
+		panic("validation error: URLs: " + s.Name)
+	}
+	for _, backend := range s.Backends {
+		if !validBackendAddress(backend, "udp") {
+			logger.Error("Validate", "error UDP service url must be 'host:port' or 'udp://host:port'", "service", s.Name, "url", backend)
+			panic("validation error: URLs: " + backend)
+		}
+	}
+	if s.Algorithm == "" {
+		s.Algorithm = "round-robin"
+	}
+}
+
+// validBackendURL reports whether backend is the URL of an HTTP server, or of a Unix
+// socket as an absolute path, optionally followed by a path prefix.
+func validBackendURL(backend string) bool {
+	u, err := url.Parse(backend)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return u.Host != "" && u.Hostname() != ""
+	case "unix":
+		return u.Host == "" && strings.HasPrefix(u.Path, "/")
+	}
+	return false
+}
+
+// validBackendAddress reports whether backend is "host:port", optionally prefixed with
+// the scheme of the protocol, as TCP and UDP backends are.
+func validBackendAddress(backend, scheme string) bool {
+	addr := strings.TrimPrefix(backend, scheme+"://")
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	return err == nil && p > 0 && p <= 65535
+}
+
+// Reload loads the config file again, like Load, but returns errors instead of exiting,
+// so that a running load balancer can keep its config when the file is broken. The
+// config returned by GetConfig is left alone: Set it once the new one is applied.
+func Reload(path string) (ConfigType, error) {
+	buff, err := os.ReadFile(path)
+	if err != nil {
+		return ConfigType{}, err
+	}
+	var conf ConfigType
+	if err := yaml.Unmarshal(buff, &conf); err != nil {
+		return ConfigType{}, err
+	}
+	setContent(buff)
+	return conf, nil
+}
+
+// Set makes conf the config returned by GetConfig.
+func Set(conf ConfigType) {
+	configMux.Lock()
+	defer configMux.Unlock()
+	config = conf
+}
+
+// Save writes conf to the config file at path. The file is replaced at once, so it is
+// never read half written.
+func Save(path string, conf ConfigType) error {
+	buff, err := yaml.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buff); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// Recorded before the rename, so watchers see it as soon as the file changes.
+	setContent(buff)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	Set(conf)
+	return nil
+}
+
+// ErrModified is returned by File.Check when the config file was changed since it was
+// last loaded or saved.
+var ErrModified = errors.New("config file changed since it was loaded")
+
+// File is the path of a config file, to which the changes of the admin API are saved.
+type File string
+
+// Check returns ErrModified when the file differs from the content last loaded or saved,
+// or does not hold loaded, so that saving a change to loaded would overwrite another one.
+func (f File) Check(loaded ConfigType) error {
+	buff, err := os.ReadFile(string(f))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrModified, err)
+	}
+	contentMux.Lock()
+	same := bytes.Equal(buff, content)
+	contentMux.Unlock()
+	var conf ConfigType
+	if !same || yaml.Unmarshal(buff, &conf) != nil {
+		return ErrModified
+	}
+	// Compared as YAML, which leaves out the differences the file cannot hold.
+	got, err := yaml.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	want, err := yaml.Marshal(loaded)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return ErrModified
+	}
+	return nil
+}
+
+// Save writes conf to the file, like Save.
+func (f File) Save(conf ConfigType) error {
+	return Save(string(f), conf)
+}
+
+// Modified reports whether the config file at path differs from the content last
+// loaded or saved.
+func Modified(path string) bool {
+	buff, err := os.ReadFile(path)
+	if err != nil {
+		return true // Let the reload report it.
+	}
+	contentMux.Lock()
+	defer contentMux.Unlock()
+	return !bytes.Equal(buff, content)
+}
+
+func setContent(buff []byte) {
+	contentMux.Lock()
+	defer contentMux.Unlock()
+	content = buff
 }
 
 func GetConfig() ConfigType {
+	configMux.RLock()
+	defer configMux.RUnlock()
 	return config
 }
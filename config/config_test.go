@@ -0,0 +1,250 @@
+package config
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidBackendURL(t *testing.T) {
+	tests := []struct {
+		backend string
+		want    bool
+	}{
+		{"http://backend", true},
+		{"http://backend:8080", true},
+		{"https://[2001:db8::1]:8443", true},
+		{"unix:///run/app.sock", true},
+		{"unix:///run/app.sock:/api", true},
+		{"", false},
+		{"backend:8080", false},
+		{"localhost:8080", false},
+		{"http://", false},
+		{"http://:8080", false},
+		{"ftp://backend", false},
+		{"unix://run/app.sock", false},
+		{"unix:run/app.sock", false},
+		{"http://backend:8080/%zz", false},
+	}
+	for _, tt := range tests {
+		if got := validBackendURL(tt.backend); got != tt.want {
+			t.Errorf("validBackendURL(%q) = %v, want %v", tt.backend, got, tt.want)
+		}
+	}
+}
+
+func TestValidBackendAddress(t *testing.T) {
+	tests := []struct {
+		backend string
+		scheme  string
+		want    bool
+	}{
+		{"db:5432", "tcp", true},
+		{"tcp://db:5432", "tcp", true},
+		{"[2001:db8::1]:53", "udp", true},
+		{"udp://dns:53", "udp", true},
+		{"udp://dns:53", "tcp", false},
+		{"db", "tcp", false},
+		{":5432", "tcp", false},
+		{"db:0", "tcp", false},
+		{"db:65536", "tcp", false},
+		{"db:postgres", "tcp", false},
+		{"http://db:5432", "tcp", false},
+	}
+	for _, tt := range tests {
+		if got := validBackendAddress(tt.backend, tt.scheme); got != tt.want {
+			t.Errorf("validBackendAddress(%q, %q) = %v, want %v", tt.backend, tt.scheme, got, tt.want)
+		}
+	}
+}
+
+func TestParseStatusRange(t *testing.T) {
+	tests := []struct {
+		s      string
+		lo, hi int
+		ok     bool
+	}{
+		{"200", 200, 200, true},
+		{"200-299", 200, 299, true},
+		{" 200 - 399 ", 200, 399, true},
+		{"599", 599, 599, true},
+		{"99", 0, 0, false},
+		{"600", 0, 0, false},
+		{"300-200", 0, 0, false},
+		{"2xx", 0, 0, false},
+		{"200-", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		lo, hi, ok := ParseStatusRange(tt.s)
+		if lo != tt.lo || hi != tt.hi || ok != tt.ok {
+			t.Errorf("ParseStatusRange(%q) = %d, %d, %v, want %d, %d, %v", tt.s, lo, hi, ok, tt.lo, tt.hi, tt.ok)
+		}
+	}
+}
+
+func TestValidateRejectsBadBackends(t *testing.T) {
+	tests := []struct {
+		name     string
+		validate func()
+	}{
+		{"http", func() { (&ServiceType{Name: "web", UrlPath: "/", Backends: []string{"backend:80"}}).Validate() }},
+		{"tcp", func() { (&TCPServiceType{Name: "db", Listen: ":5432", Backends: []string{"db"}}).Validate() }},
+		{"udp", func() { (&UDPServiceType{Name: "dns", Listen: ":53", Backends: []string{"dns:port"}}).Validate() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("invalid backend accepted")
+				}
+			}()
+			tt.validate()
+		})
+	}
+}
+
+func TestValidateRejectsUntrustedProxyProtocol(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("PROXY protocol accepted without trusted CIDRs")
+		}
+	}()
+	s := TCPServiceType{Name: "db", Listen: ":5432", Backends: []string{"db:5432"}, ProxyProtocol: ProxyProtocolConfig{Enabled: true}}
+	s.Validate()
+}
+
+func TestReloadLeavesConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("services:\n  - name: web\n    endpoint: /\n    urls: [http://a]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	prev := GetConfig()
+	t.Cleanup(func() { Set(prev) })
+	Set(ConfigType{})
+
+	conf, err := Reload(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Services) != 1 || conf.Services[0].Backends[0] != "http://a" {
+		t.Errorf("Reload() = %+v, want the service of the file", conf)
+	}
+	if len(GetConfig().Services) != 0 {
+		t.Error("Reload() changed the config before it was applied")
+	}
+	Set(conf)
+	if len(GetConfig().Services) != 1 {
+		t.Error("Set() did not change the config")
+	}
+
+	if _, err := Reload(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Reload() of a missing file succeeded")
+	}
+}
+
+func TestSave(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("services: []\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	prev := GetConfig()
+	t.Cleanup(func() { Set(prev) })
+
+	conf := ConfigType{Services: []ServiceType{{Name: "web", UrlPath: "/", Backends: []string{"http://a"}}}}
+	if err := Save(path, conf); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := Reload(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Services) != 1 || saved.Services[0].Backends[0] != "http://a" {
+		t.Errorf("saved config = %+v, want the web service", saved)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("mode of the saved file = %v (%v), want 0600", info.Mode().Perm(), err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %d files after Save, want only the config", len(entries))
+	}
+	if s := GetConfig().Services; len(s) != 1 || s[0].Name != "web" {
+		t.Errorf("GetConfig().Services = %+v, want the saved ones", s)
+	}
+
+	if Modified(path) {
+		t.Error("Modified() right after Save")
+	}
+	if err := os.WriteFile(path, []byte("services: []\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !Modified(path) {
+		t.Error("Modified() missed a change to the file")
+	}
+}
+
+func TestSaveReplacesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("services: []\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	prev := GetConfig()
+	t.Cleanup(func() { Set(prev) })
+
+	// A reader holding the old file keeps reading it whole: the file is replaced, not
+	// written over.
+	old, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	if err := Save(path, ConfigType{Services: []ServiceType{{Name: "web"}}}); err != nil {
+		t.Fatal(err)
+	}
+	buff, err := io.ReadAll(old)
+	if err != nil || string(buff) != "services: []\n" {
+		t.Errorf("old file reads %q (%v), want its content before Save", buff, err)
+	}
+}
+
+func TestFileCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("services:\n  - name: web\n    endpoint: /\n    urls: [http://a]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	prev := GetConfig()
+	t.Cleanup(func() { Set(prev) })
+	f := File(path)
+
+	loaded, err := Reload(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Check(loaded); err != nil {
+		t.Errorf("Check() of the loaded config = %v", err)
+	}
+	// A reload that was not applied leaves the file holding another config.
+	if err := f.Check(ConfigType{}); !errors.Is(err, ErrModified) {
+		t.Errorf("Check() of another config = %v, want ErrModified", err)
+	}
+
+	loaded.Services[0].Backends = append(loaded.Services[0].Backends, "http://b")
+	if err := f.Save(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Check(loaded); err != nil {
+		t.Errorf("Check() of the saved config = %v", err)
+	}
+	if err := os.WriteFile(path, []byte("services: []\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Check(loaded); !errors.Is(err, ErrModified) {
+		t.Errorf("Check() after the file changed = %v, want ErrModified", err)
+	}
+	if err := File(filepath.Join(t.TempDir(), "missing.yaml")).Check(loaded); !errors.Is(err, ErrModified) {
+		t.Errorf("Check() of a missing file = %v, want ErrModified", err)
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/vinit-chauhan/load-balancer
 
-go 1.23.0
+go 1.24.0
 
 require (
 	github.com/fsnotify/fsnotify v1.9.0
@@ -0,0 +1,305 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+	"gopkg.in/yaml.v3"
+)
+
+// ServiceStatus describes a service and its backends, as listed by the admin API.
+type ServiceStatus struct {
+	Name      string          `json:"name"`
+	Protocol  string          `json:"protocol"`
+	Path      string          `json:"path,omitempty"`   // HTTP services.
+	Listen    string          `json:"listen,omitempty"` // TCP and UDP services.
+	Algorithm string          `json:"algorithm"`
+	PanicMode bool            `json:"panic_mode"`
+	Backends  []BackendStatus `json:"backends"`
+}
+
+// BackendStatus describes a backend, as listed by the admin API.
+type BackendStatus struct {
+	URL           string `json:"url"`
+	Alive         bool   `json:"alive"` // Passes health checks.
+	State         string `json:"state"` // Administrative state: active, draining or disabled.
+	Weight        int64  `json:"weight"`
+	ActiveConns   int64  `json:"active_conns"`
+	UpgradedConns int    `json:"upgraded_conns"`
+	Circuit       string `json:"circuit"`
+}
+
+// Status describes the services and their backends, sorted by service name.
+func (lb *LoadBalancer) Status() []ServiceStatus {
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+
+	var statuses []ServiceStatus
+	add := func(svc *Service, path, listen string) {
+		status := ServiceStatus{
+			Name:      svc.Name,
+			Protocol:  svc.Protocol,
+			Path:      path,
+			Listen:    listen,
+			Algorithm: svc.Algorithm,
+			PanicMode: svc.panicking.Load(),
+			Backends:  make([]BackendStatus, 0, len(svc.Backends)),
+		}
+		for _, b := range svc.Backends {
+			status.Backends = append(status.Backends, BackendStatus{
+				URL:           b.URL.String(),
+				Alive:         b.IsAlive(),
+				State:         b.adminState().String(),
+				Weight:        b.GetWeight(),
+				ActiveConns:   b.GetActiveConns(),
+				UpgradedConns: b.GetActiveUpgrades(),
+				Circuit:       b.breaker.currentState().String(),
+			})
+		}
+		statuses = append(statuses, status)
+	}
+	for path, svc := range lb.Services {
+		add(svc, string(path), "")
+	}
+	for listen, p := range lb.TCPProxies {
+		add(p.service.Load(), "", listen)
+	}
+	for listen, p := range lb.UDPProxies {
+		add(p.service.Load(), "", listen)
+	}
+	slices.SortFunc(statuses, func(a, b ServiceStatus) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return statuses
+}
+
+// Config returns the config the load balancer runs, with the defaults filled in.
+func (lb *LoadBalancer) Config() config.ConfigType {
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+	return lb.conf
+}
+
+// effectiveConfig returns a copy of conf with the defaults filled in by validation. It
+// panics, like validation, when conf is invalid.
+func effectiveConfig(conf *config.ConfigType) config.ConfigType {
+	eff := *conf
+	eff.RateLimitStore.Validate()
+	eff.HealthChecks.Validate()
+	eff.Services = slices.Clone(conf.Services)
+	for i := range eff.Services {
+		eff.Services[i].Validate()
+	}
+	eff.TCPServices = slices.Clone(conf.TCPServices)
+	for i := range eff.TCPServices {
+		eff.TCPServices[i].Validate()
+	}
+	eff.UDPServices = slices.Clone(conf.UDPServices)
+	for i := range eff.UDPServices {
+		eff.UDPServices[i].Validate()
+	}
+	eff.Admin.Validate()
+	return eff
+}
+
+// adminAPI serves the admin API of a load balancer.
+type adminAPI struct {
+	lb     *LoadBalancer
+	token  string
+	reload func() error // Reloads the config file.
+	save   Saver        // Persists config changes, nil when they are not.
+}
+
+// NewAdminHandler returns the handler of the admin API, which requires the token as a
+// bearer token. reload is called to reload the config file, and save, when not nil, to
+// persist the services and backends changed through the API.
+//
+//	GET    /api/services             services and their backends
+//	PUT    /api/services/{name}      add or replace an HTTP or gRPC service, given as in the config file
+//	PUT    /api/tcp_services/{name}  add or replace a TCP service
+//	PUT    /api/udp_services/{name}  add or replace a UDP service
+//	DELETE /api/services/{name}      remove a service, whatever its protocol
+//	POST   /api/backends/add         {"service", "backend", "weight"}: add a backend to a service
+//	POST   /api/backends/remove      {"service", "backend"}: remove a backend from a service
+//	POST   /api/backends/state       {"service", "backend", "state"}: drain, disable or enable a backend
+//	POST   /api/backends/weight      {"service", "backend", "weight"}: change the weight of a backend
+//	POST   /api/reload               reload the config file
+//	GET    /api/config               the effective config, secrets redacted
+func NewAdminHandler(lb *LoadBalancer, token string, reload func() error, save Saver) http.Handler {
+	api := &adminAPI{lb: lb, token: token, reload: reload, save: save}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/services", api.services)
+	mux.HandleFunc("PUT /api/services/{name}", putService(api, lb.PutService, func(s *config.ServiceType) *string { return &s.Name }))
+	mux.HandleFunc("PUT /api/tcp_services/{name}", putService(api, lb.PutTCPService, func(s *config.TCPServiceType) *string { return &s.Name }))
+	mux.HandleFunc("PUT /api/udp_services/{name}", putService(api, lb.PutUDPService, func(s *config.UDPServiceType) *string { return &s.Name }))
+	mux.HandleFunc("DELETE /api/services/{name}", api.deleteService)
+	mux.HandleFunc("POST /api/backends/add", api.addBackend)
+	mux.HandleFunc("POST /api/backends/remove", api.removeBackend)
+	mux.HandleFunc("POST /api/backends/state", api.backendState)
+	mux.HandleFunc("POST /api/backends/weight", api.backendWeight)
+	mux.HandleFunc("POST /api/reload", api.reloadConfig)
+	mux.HandleFunc("GET /api/config", api.config)
+	return api.authenticate(mux)
+}
+
+// authenticate only lets requests with the right bearer token through.
+func (api *adminAPI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (api *adminAPI) services(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.lb.Status())
+}
+
+// backendRequest is the body of the requests changing a backend.
+type backendRequest struct {
+	Service string `json:"service"`
+	Backend string `json:"backend"` // URL, as listed by /api/services.
+	State   string `json:"state"`
+	Weight  int    `json:"weight"`
+}
+
+// putService returns the handler adding or replacing a service of type T with put. The
+// body is the service as in the config file, in JSON or YAML; name says where its name is.
+func putService[T any](api *adminAPI, put func(T, Saver) error, name func(*T) *string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var svc T
+		dec := yaml.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+		dec.KnownFields(true)
+		if err := dec.Decode(&svc); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid service: "+err.Error())
+			return
+		}
+		if n := name(&svc); *n == "" {
+			*n = r.PathValue("name")
+		} else if *n != r.PathValue("name") {
+			writeJSONError(w, http.StatusBadRequest, "service name differs from the one in the path")
+			return
+		}
+		api.change(w, put(svc, api.save), map[string]any{"service": r.PathValue("name")})
+	}
+}
+
+func (api *adminAPI) deleteService(w http.ResponseWriter, r *http.Request) {
+	err := api.lb.DeleteService(r.PathValue("name"), api.save)
+	api.change(w, err, map[string]any{"service": r.PathValue("name"), "deleted": true})
+}
+
+func (api *adminAPI) addBackend(w http.ResponseWriter, r *http.Request) {
+	var req backendRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	err := api.lb.AddBackend(req.Service, req.Backend, req.Weight, api.save)
+	api.change(w, err, map[string]any{"service": req.Service, "backend": req.Backend})
+}
+
+func (api *adminAPI) removeBackend(w http.ResponseWriter, r *http.Request) {
+	var req backendRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	err := api.lb.RemoveBackend(req.Service, req.Backend, api.save)
+	api.change(w, err, map[string]any{"service": req.Service, "backend": req.Backend, "removed": true})
+}
+
+// change answers a config change with resp, or with the error that prevented it.
+func (api *adminAPI) change(w http.ResponseWriter, err error, resp map[string]any) {
+	switch {
+	case errors.Is(err, errNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errConflict):
+		writeJSONError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, errNotSaved):
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+	case err != nil:
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	default:
+		resp["persisted"] = api.save != nil
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func (api *adminAPI) backendState(w http.ResponseWriter, r *http.Request) {
+	var req backendRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	inFlight, upgrades, err := api.lb.SetBackendState(req.Service, req.Backend, req.State)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"state": req.State, "in_flight": inFlight, "upgraded": upgrades})
+}
+
+func (api *adminAPI) backendWeight(w http.ResponseWriter, r *http.Request) {
+	var req backendRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	err := api.lb.SetBackendWeight(req.Service, req.Backend, req.Weight, api.save)
+	api.change(w, err, map[string]any{"service": req.Service, "backend": req.Backend, "weight": req.Weight})
+}
+
+func (api *adminAPI) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if err := api.reload(); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"reloaded": true})
+}
+
+// config writes the effective config as JSON, with the keys of the config file.
+func (api *adminAPI) config(w http.ResponseWriter, r *http.Request) {
+	conf := api.lb.Config()
+	if conf.Admin.Token != "" {
+		conf.Admin.Token = "REDACTED"
+	}
+	if conf.RateLimitStore.Redis.Password != "" {
+		conf.RateLimitStore.Redis.Password = "REDACTED"
+	}
+	// Round-trip through YAML, which knows the key names.
+	buf, err := yaml.Marshal(conf)
+	var doc map[string]any
+	if err == nil {
+		err = yaml.Unmarshal(buf, &doc)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, doc)
+}
+
+// readJSON decodes the JSON body of a request, and answers with 400 when it cannot.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
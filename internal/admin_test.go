@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+// adminRequest sends a request to the admin API, with the token when it is not empty.
+func adminRequest(h http.Handler, token, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	h := NewAdminHandler(newTestLoadBalancer(t, webConfig()), "secret", nil, nil)
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"no token", ""},
+		{"wrong token", "Bearer guess"},
+		{"token prefix", "Bearer secre"},
+		{"other scheme", "Basic secret"},
+		{"no scheme", "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/services", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("status = %d, WWW-Authenticate = %q; want 401 and Bearer", w.Code, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	if w := adminRequest(h, "secret", http.MethodGet, "/api/services", ""); w.Code != http.StatusOK {
+		t.Errorf("status with the token = %d, want 200", w.Code)
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	conf := webConfig()
+	conf.Admin.Token = "secret"
+	lb := newTestLoadBalancer(t, conf)
+	reloaded := false
+	h := NewAdminHandler(lb, "secret", func() error { reloaded = true; return nil }, nil)
+
+	w := adminRequest(h, "secret", http.MethodGet, "/api/services", "")
+	var services []ServiceStatus
+	if err := json.NewDecoder(w.Body).Decode(&services); err != nil || len(services) != 1 || len(services[0].Backends) != 2 {
+		t.Errorf("GET /api/services = %s, want the web service and its 2 backends", w.Body)
+	}
+
+	w = adminRequest(h, "secret", http.MethodPost, "/api/backends/state", `{"service": "web", "backend": "http://a", "state": "draining"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"state":"draining"`) {
+		t.Errorf("POST /api/backends/state = %d %s, want 200 and the state", w.Code, w.Body)
+	}
+	w = adminRequest(h, "secret", http.MethodPost, "/api/backends/state", `{"service": "web", "backend": "http://a", "state": "asleep"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST /api/backends/state with an unknown state = %d, want 400", w.Code)
+	}
+	w = adminRequest(h, "secret", http.MethodPost, "/api/backends/weight", `{"service": "web", "backend": "http://b", "weight": 5}`)
+	if w.Code != http.StatusOK || lb.GetServices("/").Backends[1].GetWeight() != 5 {
+		t.Errorf("POST /api/backends/weight = %d %s, want 200 and the weight set", w.Code, w.Body)
+	}
+	w = adminRequest(h, "secret", http.MethodPost, "/api/backends/weight", `{"service": "web"`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST /api/backends/weight with broken JSON = %d, want 400", w.Code)
+	}
+
+	w = adminRequest(h, "secret", http.MethodGet, "/api/config", "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "secret") || !strings.Contains(w.Body.String(), "REDACTED") {
+		t.Errorf("GET /api/config = %d %s, want 200 with the token redacted", w.Code, w.Body)
+	}
+
+	if w = adminRequest(h, "secret", http.MethodPost, "/api/reload", ""); w.Code != http.StatusOK || !reloaded {
+		t.Errorf("POST /api/reload = %d, reloaded %v; want 200 and a reload", w.Code, reloaded)
+	}
+	if w = adminRequest(h, "secret", http.MethodGet, "/api/unknown", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /api/unknown = %d, want 404", w.Code)
+	}
+}
+
+func TestAdminRefusesChangedConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	file := "services:\n  - name: web\n    endpoint: /\n    urls: [http://a, http://b]\n"
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	prev := config.GetConfig()
+	t.Cleanup(func() { config.Set(prev) })
+	conf, err := config.Reload(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := newTestLoadBalancer(t, conf)
+	h := NewAdminHandler(lb, "secret", nil, config.File(path))
+
+	add := func(backend string) *httptest.ResponseRecorder {
+		return adminRequest(h, "secret", http.MethodPost, "/api/backends/add", `{"service": "web", "backend": "`+backend+`"}`)
+	}
+	if w := add("http://c"); w.Code != http.StatusOK {
+		t.Fatalf("POST /api/backends/add = %d %s, want 200", w.Code, w.Body)
+	}
+	if w := add("http://d"); w.Code != http.StatusOK {
+		t.Fatalf("POST /api/backends/add after a save = %d %s, want 200", w.Code, w.Body)
+	}
+
+	// Someone edits the file: changes are refused until it is reloaded.
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if w := add("http://e"); w.Code != http.StatusConflict {
+		t.Errorf("POST /api/backends/add over an edited file = %d %s, want 409", w.Code, w.Body)
+	}
+	if n := len(lb.GetServices("/").Backends); n != 4 {
+		t.Errorf("backends after a refused change = %d, want 4", n)
+	}
+	if buff, _ := os.ReadFile(path); string(buff) != file {
+		t.Errorf("edited file overwritten by a refused change: %q", buff)
+	}
+
+	// A reload of the file that fails leaves it apart from the running config too.
+	if err := os.WriteFile(path, []byte("services:\n  - name: web\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err = lb.ReloadConfig(func() (config.ConfigType, error) { return config.Reload(path) }, nil)
+	if err == nil {
+		t.Fatal("invalid config reloaded")
+	}
+	if w := add("http://e"); w.Code != http.StatusConflict {
+		t.Errorf("POST /api/backends/add after a failed reload = %d %s, want 409", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+	"github.com/vinit-chauhan/load-balancer/logger"
+)
+
+// Defaults of the circuit breaker settings.
+const (
+	defaultBreakerWindow           = 10 * time.Second
+	defaultBreakerMinRequests      = 20
+	defaultBreakerErrorRate        = 0.5
+	defaultBreakerSlowRate         = 0.5
+	defaultBreakerOpenDuration     = 30 * time.Second
+	defaultBreakerHalfOpenRequests = 3
+	breakerBuckets                 = 10 // The rolling window is split into this many buckets.
+)
+
+// breakerState is the state of a circuit breaker, also used as the value of the state gauge.
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // Requests flow, results are counted.
+	breakerHalfOpen                     // A few probe requests are let through.
+	breakerOpen                         // The backend is skipped.
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// breakerBucket counts the results of the requests that completed in a slice of the window.
+type breakerBucket struct {
+	start    time.Time
+	total    int
+	failures int
+	slow     int
+}
+
+// circuitBreaker stops sending requests to a backend that fails or answers slowly too
+// often, even though it still passes health checks. Once the error or slow call rate
+// over the rolling window crosses its threshold the circuit opens; after openDuration
+// it lets halfOpenRequests probes through, and closes again if they all succeed.
+//
+// A nil *circuitBreaker is always closed, so backends of services without a breaker
+// need no special casing.
+type circuitBreaker struct {
+	service, backend string
+
+	window           time.Duration
+	minRequests      int
+	errorRate        float64
+	slowDuration     time.Duration // 0 means latency is not considered.
+	slowRate         float64
+	openDuration     time.Duration
+	halfOpenRequests int
+
+	mux       sync.Mutex
+	state     breakerState
+	openedAt  time.Time
+	buckets   [breakerBuckets]breakerBucket
+	probes    int // Half-open probes let through.
+	successes int // Half-open probes that succeeded.
+}
+
+// newCircuitBreaker builds the breaker of a backend of the service, or returns nil
+// when the service has no circuit breaker.
+func newCircuitBreaker(serviceConf config.ServiceType, backend string) *circuitBreaker {
+	conf := serviceConf.CircuitBreaker
+	if !conf.Enabled {
+		return nil
+	}
+	cb := &circuitBreaker{
+		service:          serviceConf.Name,
+		backend:          backend,
+		window:           parseTimeout(conf.Window, defaultBreakerWindow),
+		minRequests:      conf.MinRequests,
+		errorRate:        conf.ErrorRate,
+		slowDuration:     parseTimeout(conf.SlowCallDuration, 0),
+		slowRate:         conf.SlowCallRate,
+		openDuration:     parseTimeout(conf.OpenDuration, defaultBreakerOpenDuration),
+		halfOpenRequests: conf.HalfOpenRequests,
+	}
+	if cb.minRequests <= 0 {
+		cb.minRequests = defaultBreakerMinRequests
+	}
+	if cb.errorRate <= 0 {
+		cb.errorRate = defaultBreakerErrorRate
+	}
+	if cb.slowRate <= 0 {
+		cb.slowRate = defaultBreakerSlowRate
+	}
+	if cb.halfOpenRequests <= 0 {
+		cb.halfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+	CircuitBreakerState.WithLabelValues(cb.service, cb.backend).Set(float64(breakerClosed))
+	return cb
+}
+
+// ready reports whether the backend may be picked: the circuit is closed, or it is
+// half-open with probe slots left, or it has been open for long enough to be probed.
+func (cb *circuitBreaker) ready() bool {
+	if cb == nil {
+		return true
+	}
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	switch cb.state {
+	case breakerOpen:
+		return time.Since(cb.openedAt) >= cb.openDuration
+	case breakerHalfOpen:
+		return cb.probes < cb.halfOpenRequests
+	default:
+		return true
+	}
+}
+
+// currentState returns the state of the circuit.
+func (cb *circuitBreaker) currentState() breakerState {
+	if cb == nil {
+		return breakerClosed
+	}
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	return cb.state
+}
+
+// closed reports whether the circuit is closed, i.e. requests flow freely.
+func (cb *circuitBreaker) closed() bool {
+	if cb == nil {
+		return true
+	}
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	return cb.state == breakerClosed
+}
+
+// allow admits a request to the picked backend, taking a probe slot when the circuit
+// is half-open. It returns false when another request took the last slot first.
+func (cb *circuitBreaker) allow() bool {
+	if cb == nil {
+		return true
+	}
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	if cb.state == breakerOpen {
+		if time.Since(cb.openedAt) < cb.openDuration {
+			return false
+		}
+		cb.transition(breakerHalfOpen)
+	}
+	if cb.state == breakerHalfOpen {
+		if cb.probes >= cb.halfOpenRequests {
+			return false
+		}
+		cb.probes++
+	}
+	return true
+}
+
+// release gives back the probe slot of a request admitted by allow that ended without
+// a result, such as one canceled by its client. Without it, a half-open circuit whose
+// probes were all canceled would wait for results forever.
+func (cb *circuitBreaker) release() {
+	if cb == nil {
+		return
+	}
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	if cb.state == breakerHalfOpen && cb.probes > cb.successes {
+		cb.probes--
+	}
+}
+
+// record counts the result of a request admitted by allow.
+func (cb *circuitBreaker) record(failed bool, latency time.Duration) {
+	if cb == nil {
+		return
+	}
+	slow := cb.slowDuration > 0 && latency >= cb.slowDuration
+
+	cb.mux.Lock()
+	defer cb.mux.Unlock()
+	switch cb.state {
+	case breakerOpen:
+		// A request admitted before the circuit opened.
+	case breakerHalfOpen:
+		if failed || slow {
+			cb.transition(breakerOpen)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.halfOpenRequests {
+			cb.transition(breakerClosed)
+		}
+	default:
+		now := time.Now()
+		b := cb.bucket(now)
+		b.total++
+		if failed {
+			b.failures++
+		}
+		if slow {
+			b.slow++
+		}
+		total, failures, slowCalls := cb.totals(now)
+		if total < cb.minRequests {
+			return
+		}
+		if float64(failures)/float64(total) >= cb.errorRate ||
+			(cb.slowDuration > 0 && float64(slowCalls)/float64(total) >= cb.slowRate) {
+			cb.transition(breakerOpen)
+		}
+	}
+}
+
+// bucket returns the bucket counting the requests completed at now, resetting it
+// when it last counted an older slice of the window. The caller must hold cb.mux.
+func (cb *circuitBreaker) bucket(now time.Time) *breakerBucket {
+	width := max(cb.window/breakerBuckets, 1) // Tiny windows would divide by zero.
+	start := now.Truncate(width)
+	b := &cb.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+	if !b.start.Equal(start) {
+		*b = breakerBucket{start: start}
+	}
+	return b
+}
+
+// totals sums the buckets that are still in the window. The caller must hold cb.mux.
+func (cb *circuitBreaker) totals(now time.Time) (total, failures, slow int) {
+	for _, b := range cb.buckets {
+		if now.Sub(b.start) < cb.window {
+			total += b.total
+			failures += b.failures
+			slow += b.slow
+		}
+	}
+	return total, failures, slow
+}
+
+// transition moves the circuit to state, resetting what the new state counts.
+// The caller must hold cb.mux.
+func (cb *circuitBreaker) transition(state breakerState) {
+	from := cb.state
+	cb.state = state
+	cb.probes, cb.successes = 0, 0
+	switch state {
+	case breakerOpen:
+		cb.openedAt = time.Now()
+	case breakerClosed:
+		cb.buckets = [breakerBuckets]breakerBucket{}
+	}
+
+	CircuitBreakerState.WithLabelValues(cb.service, cb.backend).Set(float64(state))
+	CircuitBreakerTransitionsTotal.WithLabelValues(cb.service, cb.backend, from.String(), state.String()).Inc()
+	if state == breakerOpen {
+		logger.Warn("CircuitBreaker", "Circuit opened", "service", cb.service, "backend", cb.backend, "from", from.String())
+	} else {
+		logger.Info("CircuitBreaker", "Circuit state changed", "service", cb.service, "backend", cb.backend, "from", from.String(), "to", state.String())
+	}
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+func newTestBreaker(t *testing.T, conf config.BreakerConfig) *circuitBreaker {
+	t.Helper()
+	conf.Enabled = true
+	return newCircuitBreaker(config.ServiceType{Name: t.Name(), CircuitBreaker: conf}, "http://backend")
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    config.BreakerConfig
+		results []bool // Failed requests, in order.
+		latency time.Duration
+		want    breakerState
+	}{
+		{
+			name:    "below min requests",
+			conf:    config.BreakerConfig{MinRequests: 5},
+			results: []bool{true, true, true, true},
+			want:    breakerClosed,
+		},
+		{
+			name:    "error rate reached",
+			conf:    config.BreakerConfig{MinRequests: 4, ErrorRate: 0.5},
+			results: []bool{false, true, false, true},
+			want:    breakerOpen,
+		},
+		{
+			name:    "error rate not reached",
+			conf:    config.BreakerConfig{MinRequests: 4, ErrorRate: 0.5},
+			results: []bool{false, true, false, false},
+			want:    breakerClosed,
+		},
+		{
+			name:    "slow calls",
+			conf:    config.BreakerConfig{MinRequests: 2, SlowCallDuration: "10ms", SlowCallRate: 0.5},
+			results: []bool{false, false},
+			latency: 20 * time.Millisecond,
+			want:    breakerOpen,
+		},
+		{
+			name:    "latency ignored without slow_call_duration",
+			conf:    config.BreakerConfig{MinRequests: 2},
+			results: []bool{false, false},
+			latency: time.Hour,
+			want:    breakerClosed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := newTestBreaker(t, tt.conf)
+			for _, failed := range tt.results {
+				if !cb.allow() {
+					t.Fatal("allow() = false while closed")
+				}
+				cb.record(failed, tt.latency)
+			}
+			if got := cb.currentState(); got != tt.want {
+				t.Errorf("state = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []bool
+		want    breakerState
+	}{
+		{"probes succeed", []bool{false, false}, breakerClosed},
+		{"probe fails", []bool{false, true}, breakerOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := newTestBreaker(t, config.BreakerConfig{MinRequests: 1, OpenDuration: "1ms", HalfOpenRequests: 2})
+			cb.allow()
+			cb.record(true, 0)
+			if cb.ready() {
+				t.Fatal("ready() = true right after opening")
+			}
+			time.Sleep(2 * time.Millisecond)
+
+			for range tt.results {
+				if !cb.allow() {
+					t.Fatal("allow() = false with probe slots left")
+				}
+			}
+			if cb.allow() {
+				t.Fatal("allow() = true with every probe slot taken")
+			}
+			for _, failed := range tt.results {
+				cb.record(failed, 0)
+			}
+			if got := cb.currentState(); got != tt.want {
+				t.Errorf("state = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerReleaseCanceledProbes(t *testing.T) {
+	cb := newTestBreaker(t, config.BreakerConfig{MinRequests: 1, OpenDuration: "1ms", HalfOpenRequests: 2})
+	cb.allow()
+	cb.record(true, 0)
+	time.Sleep(2 * time.Millisecond)
+
+	// Both probes are canceled by their clients, and never recorded.
+	cb.allow()
+	cb.allow()
+	cb.release()
+	cb.release()
+	if cb.currentState() != breakerHalfOpen || !cb.ready() {
+		t.Fatalf("state = %v, ready = %v after canceled probes, want half-open and ready", cb.currentState(), cb.ready())
+	}
+
+	cb.allow()
+	cb.record(false, 0)
+	cb.allow()
+	cb.record(false, 0)
+	if got := cb.currentState(); got != breakerClosed {
+		t.Errorf("state = %v after successful probes, want closed", got)
+	}
+}
+
+func TestCircuitBreakerReleaseKeepsRecordedProbes(t *testing.T) {
+	cb := newTestBreaker(t, config.BreakerConfig{MinRequests: 1, OpenDuration: "1ms", HalfOpenRequests: 2})
+	cb.allow()
+	cb.record(true, 0)
+	time.Sleep(2 * time.Millisecond)
+
+	cb.allow()
+	cb.record(false, 0)
+	cb.release() // Nothing in flight: must not hand out a third probe.
+	cb.allow()
+	if cb.allow() {
+		t.Error("allow() = true with every probe slot taken")
+	}
+}
+
+func TestCircuitBreakerTinyWindow(t *testing.T) {
+	cb := newTestBreaker(t, config.BreakerConfig{Window: "5ns", MinRequests: 1})
+	cb.allow()
+	cb.record(false, 0) // Used to divide by zero.
+}
+
+func TestNilCircuitBreaker(t *testing.T) {
+	var cb *circuitBreaker
+	if !cb.ready() || !cb.allow() || !cb.closed() {
+		t.Error("nil breaker is not closed")
+	}
+	cb.record(true, 0)
+	cb.release()
+}
@@ -0,0 +1,313 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+	"github.com/vinit-chauhan/load-balancer/logger"
+)
+
+var (
+	// errNotFound is returned for changes to services or backends that do not exist.
+	errNotFound = errors.New("not found")
+	// errNotSaved is returned when a change could not be written to the config file,
+	// and was undone.
+	errNotSaved = errors.New("config not saved, change undone")
+	// errConflict is returned when the saved config is no longer the one the load
+	// balancer runs, as it was changed by someone else.
+	errConflict = errors.New("config changed elsewhere, reload it first")
+)
+
+// A Saver persists the changes made through UpdateConfig.
+type Saver interface {
+	// Check returns an error when the saved config is no longer loaded, the config the
+	// load balancer was last given, so that saving a change would overwrite another one.
+	Check(loaded config.ConfigType) error
+	// Save persists conf.
+	Save(conf config.ConfigType) error
+}
+
+// ReloadConfig loads a config with load, validates it and applies it, like
+// UpdateServices, but returns an error instead of panicking when it is invalid. An
+// invalid config changes nothing. Loading and applying are serialized with the changes
+// of UpdateConfig, so a reload never reads the config file before a change is saved
+// and applies it after. applied, when not nil, is called with the config once it runs.
+func (lb *LoadBalancer) ReloadConfig(load func() (config.ConfigType, error), applied func(config.ConfigType)) error {
+	lb.changeMux.Lock()
+	defer lb.changeMux.Unlock()
+	conf, err := load()
+	if err != nil {
+		return err
+	}
+	if err := lb.applyConfig(&conf); err != nil {
+		return err
+	}
+	if applied != nil {
+		applied(conf)
+	}
+	return nil
+}
+
+// applyConfig applies conf, turning the panics of validation into an error. The caller
+// must hold lb.changeMux.
+func (lb *LoadBalancer) applyConfig(conf *config.ConfigType) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return lb.UpdateServices(conf)
+}
+
+// UpdateConfig changes the config of the load balancer: change edits a copy of the
+// current one, which is then applied like a reload. When save is not nil, it persists
+// the changed config; if it fails, the previous config is restored, so the load
+// balancer never runs a config that the file does not have. A change is refused before
+// it is applied when the saved config is no longer the one running, as saving it would
+// overwrite changes made elsewhere.
+func (lb *LoadBalancer) UpdateConfig(change func(*config.ConfigType) error, save Saver) error {
+	lb.changeMux.Lock()
+	defer lb.changeMux.Unlock()
+
+	lb.mux.RLock()
+	prev := cloneConfig(&lb.source)
+	lb.mux.RUnlock()
+	if save != nil {
+		if err := save.Check(prev); err != nil {
+			return fmt.Errorf("%w: %v", errConflict, err)
+		}
+	}
+
+	next := cloneConfig(&prev)
+	if err := change(&next); err != nil {
+		return err
+	}
+	if err := checkUnique(&next); err != nil {
+		return err
+	}
+	if err := lb.applyConfig(&next); err != nil {
+		return err
+	}
+	if save == nil {
+		return nil
+	}
+	if err := save.Save(next); err != nil {
+		if err := lb.applyConfig(&prev); err != nil {
+			logger.Error("UpdateConfig", "error restoring the previous config", "error", err)
+		}
+		return fmt.Errorf("%w: %v", errNotSaved, err)
+	}
+	return nil
+}
+
+// PutService adds an HTTP or gRPC service, or replaces the one with the same name.
+func (lb *LoadBalancer) PutService(svc config.ServiceType, save Saver) error {
+	return lb.UpdateConfig(func(conf *config.ConfigType) error {
+		conf.Services = putNamed(conf.Services, svc, func(s config.ServiceType) string { return s.Name })
+		return nil
+	}, save)
+}
+
+// PutTCPService adds a TCP service, or replaces the one with the same name.
+func (lb *LoadBalancer) PutTCPService(svc config.TCPServiceType, save Saver) error {
+	return lb.UpdateConfig(func(conf *config.ConfigType) error {
+		conf.TCPServices = putNamed(conf.TCPServices, svc, func(s config.TCPServiceType) string { return s.Name })
+		return nil
+	}, save)
+}
+
+// PutUDPService adds a UDP service, or replaces the one with the same name.
+func (lb *LoadBalancer) PutUDPService(svc config.UDPServiceType, save Saver) error {
+	return lb.UpdateConfig(func(conf *config.ConfigType) error {
+		conf.UDPServices = putNamed(conf.UDPServices, svc, func(s config.UDPServiceType) string { return s.Name })
+		return nil
+	}, save)
+}
+
+// DeleteService removes the service with the name, whatever its protocol.
+func (lb *LoadBalancer) DeleteService(name string, save Saver) error {
+	return lb.UpdateConfig(func(conf *config.ConfigType) error {
+		n := len(conf.Services) + len(conf.TCPServices) + len(conf.UDPServices)
+		conf.Services = slices.DeleteFunc(conf.Services, func(s config.ServiceType) bool { return s.Name == name })
+		conf.TCPServices = slices.DeleteFunc(conf.TCPServices, func(s config.TCPServiceType) bool { return s.Name == name })
+		conf.UDPServices = slices.DeleteFunc(conf.UDPServices, func(s config.UDPServiceType) bool { return s.Name == name })
+		if len(conf.Services)+len(conf.TCPServices)+len(conf.UDPServices) == n {
+			return fmt.Errorf("%w: no service %q", errNotFound, name)
+		}
+		return nil
+	}, save)
+}
+
+// AddBackend adds a backend to the named service. Adding a backend the service already
+// has only changes its weight, when one is given; weights (1 to 100) only apply to HTTP
+// and gRPC services, 0 leaving the weight alone.
+func (lb *LoadBalancer) AddBackend(service, backend string, weight int, save Saver) error {
+	if backend == "" {
+		return errors.New("backend url cannot be empty")
+	}
+	return lb.UpdateConfig(func(conf *config.ConfigType) error {
+		backends, weights, err := serviceBackends(conf, service)
+		if err != nil {
+			return err
+		}
+		if weight != 0 && weights == nil {
+			return fmt.Errorf("service %q does not support weights", service)
+		}
+		if !slices.Contains(*backends, backend) {
+			*backends = append(*backends, backend)
+		}
+		if weight != 0 {
+			if *weights == nil {
+				*weights = make(map[string]int)
+			}
+			(*weights)[backend] = weight
+		}
+		return nil
+	}, save)
+}
+
+// RemoveBackend removes a backend from the named service. Its requests in flight are
+// let finish, as on reloads.
+func (lb *LoadBalancer) RemoveBackend(service, backend string, save Saver) error {
+	return lb.UpdateConfig(func(conf *config.ConfigType) error {
+		backends, weights, err := serviceBackends(conf, service)
+		if err != nil {
+			return err
+		}
+		i := slices.Index(*backends, backend)
+		if i < 0 {
+			return fmt.Errorf("%w: no backend %q in service %q", errNotFound, backend, service)
+		}
+		*backends = slices.Delete(*backends, i, i+1)
+		if weights != nil {
+			delete(*weights, backend)
+		}
+		return nil
+	}, save)
+}
+
+// SetBackendWeight changes the weight (1 to 100) of a backend of the named HTTP or gRPC
+// service, as a change of its weight in the config would.
+func (lb *LoadBalancer) SetBackendWeight(service, backend string, weight int, save Saver) error {
+	if weight < 1 || weight > 100 {
+		return fmt.Errorf("weight must be between 1 and 100, got %d", weight)
+	}
+	return lb.UpdateConfig(func(conf *config.ConfigType) error {
+		backends, weights, err := serviceBackends(conf, service)
+		if err != nil {
+			return err
+		}
+		if weights == nil {
+			return fmt.Errorf("service %q does not support weights", service)
+		}
+		if !slices.Contains(*backends, backend) {
+			return fmt.Errorf("%w: no backend %q in service %q", errNotFound, backend, service)
+		}
+		if *weights == nil {
+			*weights = make(map[string]int)
+		}
+		(*weights)[backend] = weight
+		return nil
+	}, save)
+}
+
+// serviceBackends returns the backends of the named service in conf, and its weights
+// when it has some (HTTP and gRPC services).
+func serviceBackends(conf *config.ConfigType, name string) (*[]string, *map[string]int, error) {
+	for i := range conf.Services {
+		if s := &conf.Services[i]; s.Name == name {
+			return &s.Backends, &s.Weights, nil
+		}
+	}
+	for i := range conf.TCPServices {
+		if s := &conf.TCPServices[i]; s.Name == name {
+			return &s.Backends, nil, nil
+		}
+	}
+	for i := range conf.UDPServices {
+		if s := &conf.UDPServices[i]; s.Name == name {
+			return &s.Backends, nil, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%w: no service %q", errNotFound, name)
+}
+
+// putNamed replaces the item of list with the name of item, or appends item.
+func putNamed[T any](list []T, item T, name func(T) string) []T {
+	for i := range list {
+		if name(list[i]) == name(item) {
+			list[i] = item
+			return list
+		}
+	}
+	return append(list, item)
+}
+
+// checkUnique checks that services have a name, used by no other service, and that
+// no two services share an endpoint or a listen address.
+func checkUnique(conf *config.ConfigType) error {
+	names := make(map[string]bool)
+	name := func(n string) error {
+		if n == "" {
+			return errors.New("service needs a name")
+		}
+		if names[n] {
+			return fmt.Errorf("duplicate service name %q", n)
+		}
+		names[n] = true
+		return nil
+	}
+	endpoints := make(map[string]bool)
+	for _, s := range conf.Services {
+		if err := name(s.Name); err != nil {
+			return err
+		}
+		if endpoints[s.UrlPath] {
+			return fmt.Errorf("duplicate service endpoint %q", s.UrlPath)
+		}
+		endpoints[s.UrlPath] = true
+	}
+	listens := make(map[string]bool)
+	for _, s := range conf.TCPServices {
+		if err := name(s.Name); err != nil {
+			return err
+		}
+		if listens["tcp "+s.Listen] {
+			return fmt.Errorf("duplicate TCP listen address %q", s.Listen)
+		}
+		listens["tcp "+s.Listen] = true
+	}
+	for _, s := range conf.UDPServices {
+		if err := name(s.Name); err != nil {
+			return err
+		}
+		if listens["udp "+s.Listen] {
+			return fmt.Errorf("duplicate UDP listen address %q", s.Listen)
+		}
+		listens["udp "+s.Listen] = true
+	}
+	return nil
+}
+
+// cloneConfig copies conf deep enough for the copy's services and their backends to
+// be changed without changing conf.
+func cloneConfig(conf *config.ConfigType) config.ConfigType {
+	c := *conf
+	c.Services = slices.Clone(conf.Services)
+	for i := range c.Services {
+		c.Services[i].Backends = slices.Clone(c.Services[i].Backends)
+		c.Services[i].Weights = maps.Clone(c.Services[i].Weights)
+	}
+	c.TCPServices = slices.Clone(conf.TCPServices)
+	for i := range c.TCPServices {
+		c.TCPServices[i].Backends = slices.Clone(c.TCPServices[i].Backends)
+	}
+	c.UDPServices = slices.Clone(conf.UDPServices)
+	for i := range c.UDPServices {
+		c.UDPServices[i].Backends = slices.Clone(c.UDPServices[i].Backends)
+	}
+	return c
+}
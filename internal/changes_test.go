@@ -0,0 +1,398 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+// newTestLoadBalancer builds a load balancer running conf, stopped with the test.
+func newTestLoadBalancer(t *testing.T, conf config.ConfigType) *LoadBalancer {
+	t.Helper()
+	lb := NewLoadBalancer(&conf)
+	t.Cleanup(func() {
+		for _, svc := range lb.allServices() {
+			svc.Stop()
+		}
+		lb.StopTCPProxies(t.Context())
+		lb.StopUDPProxies()
+	})
+	return lb
+}
+
+// saveFunc is a Saver whose config is never changed elsewhere.
+type saveFunc func(config.ConfigType) error
+
+func (f saveFunc) Check(config.ConfigType) error     { return nil }
+func (f saveFunc) Save(conf config.ConfigType) error { return f(conf) }
+
+// webConfig is a config with one HTTP service, "web", with backends a and b.
+func webConfig() config.ConfigType {
+	return config.ConfigType{Services: []config.ServiceType{
+		{Name: "web", UrlPath: "/", Backends: []string{"http://a", "http://b"}},
+	}}
+}
+
+func TestSetBackendWeight(t *testing.T) {
+	lb := newTestLoadBalancer(t, webConfig())
+	var saved []config.ConfigType
+	save := saveFunc(func(conf config.ConfigType) error {
+		saved = append(saved, conf)
+		return nil
+	})
+
+	if err := lb.SetBackendWeight("web", "http://a", 3, save); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].Services[0].Weights["http://a"] != 3 {
+		t.Errorf("saved configs = %+v, want one with weight 3 for http://a", saved)
+	}
+	if w := lb.Config().Services[0].Weights["http://a"]; w != 3 {
+		t.Errorf("weight in config = %d, want 3", w)
+	}
+	if w := lb.GetServices("/").Backends[0].GetWeight(); w != 3 {
+		t.Errorf("weight of backend = %d, want 3", w)
+	}
+
+	// Later changes start from the config with the weight.
+	if err := lb.AddBackend("web", "http://c", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if w := lb.GetServices("/").Backends[0].GetWeight(); w != 3 {
+		t.Errorf("weight of backend after another change = %d, want 3", w)
+	}
+}
+
+func TestSetBackendWeightErrors(t *testing.T) {
+	conf := webConfig()
+	conf.TCPServices = []config.TCPServiceType{{Name: "db", Listen: "127.0.0.1:0", Backends: []string{"127.0.0.1:5432"}}}
+	lb := newTestLoadBalancer(t, conf)
+	tests := []struct {
+		name    string
+		service string
+		backend string
+		weight  int
+		save    Saver
+		wantErr error // Checked with errors.Is, when set.
+	}{
+		{name: "weight too low", service: "web", backend: "http://a", weight: 0},
+		{name: "weight too high", service: "web", backend: "http://a", weight: 101},
+		{name: "unknown service", service: "api", backend: "http://a", weight: 2, wantErr: errNotFound},
+		{name: "unknown backend", service: "web", backend: "http://z", weight: 2, wantErr: errNotFound},
+		{name: "TCP service", service: "db", backend: "127.0.0.1:5432", weight: 2},
+		{
+			name: "save fails", service: "web", backend: "http://a", weight: 2,
+			save:    saveFunc(func(config.ConfigType) error { return errors.New("disk full") }),
+			wantErr: errNotSaved,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := lb.SetBackendWeight(tt.service, tt.backend, tt.weight, tt.save)
+			if err == nil || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if w := lb.GetServices("/").Backends[0].GetWeight(); w != 1 {
+				t.Errorf("weight of backend = %d after a failed change, want 1", w)
+			}
+			if _, ok := lb.Config().Services[0].Weights["http://a"]; ok {
+				t.Error("failed change kept in config")
+			}
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	lb := newTestLoadBalancer(t, webConfig())
+	invalid := webConfig()
+	invalid.Services[0].Backends = []string{"not a url"}
+	next := webConfig()
+	next.Services[0].Backends = []string{"http://c"}
+	tests := []struct {
+		name        string
+		load        func() (config.ConfigType, error)
+		wantErr     bool
+		wantBackend string // First backend running afterwards.
+	}{
+		{"unreadable", func() (config.ConfigType, error) { return config.ConfigType{}, errors.New("no such file") }, true, "http://a"},
+		{"invalid", func() (config.ConfigType, error) { return invalid, nil }, true, "http://a"},
+		{"valid", func() (config.ConfigType, error) { return next, nil }, false, "http://c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			applied := false
+			err := lb.ReloadConfig(tt.load, func(config.ConfigType) { applied = true })
+			if (err != nil) != tt.wantErr || applied == tt.wantErr {
+				t.Errorf("err = %v, applied = %v, want error %v", err, applied, tt.wantErr)
+			}
+			if got := lb.GetServices("/").Backends[0].URL.String(); got != tt.wantBackend {
+				t.Errorf("backend = %s, want %s", got, tt.wantBackend)
+			}
+			if got := lb.Config().Services[0].Backends[0]; got != tt.wantBackend {
+				t.Errorf("backend in config = %s, want %s", got, tt.wantBackend)
+			}
+		})
+	}
+}
+
+func TestUpdateConfigKeepsState(t *testing.T) {
+	conf := webConfig()
+	conf.Services[0].Hedging = config.HedgingConfig{Enabled: true, Delay: "10ms"}
+	conf.Services = append(conf.Services, config.ServiceType{Name: "api", UrlPath: "/api/", Backends: []string{"http://d"}})
+	conf.TCPServices = []config.TCPServiceType{{Name: "db", Listen: "127.0.0.1:0", Backends: []string{"127.0.0.1:5432"}}}
+	lb := newTestLoadBalancer(t, conf)
+	web, api := lb.GetServices("/"), lb.GetServices("/api/")
+	a, b := web.Backends[0], web.Backends[1]
+	a.IncConn()
+	db := lb.TCPProxies["127.0.0.1:0"].service.Load()
+
+	if err := lb.AddBackend("web", "http://c", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if lb.GetServices("/api/") != api {
+		t.Error("unchanged service rebuilt")
+	}
+	if lb.TCPProxies["127.0.0.1:0"].service.Load() != db {
+		t.Error("unchanged TCP service rebuilt")
+	}
+	next := lb.GetServices("/")
+	if next == web || len(next.Backends) != 3 {
+		t.Fatalf("changed service not rebuilt with the new backend")
+	}
+	if next.Backends[0] != a || next.Backends[1] != b || a.GetActiveConns() != 1 {
+		t.Error("unchanged backends not kept with their connections")
+	}
+	if next.hedger != web.hedger {
+		t.Error("hedging state not kept")
+	}
+
+	// Backends built with other settings are rebuilt.
+	if err := lb.UpdateConfig(func(conf *config.ConfigType) error {
+		conf.Services[0].Timeouts.Dial = "1s"
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if lb.GetServices("/").Backends[0] == a {
+		t.Error("backend kept although its transport settings changed")
+	}
+}
+
+func TestUpdateConfigChecksOutsideLock(t *testing.T) {
+	checked := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case checked <- struct{}{}:
+		default:
+		}
+		<-release
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	conf := webConfig()
+	conf.Services[0].Backends = []string{fast.URL}
+	conf.Services[0].HealthCheck = config.HealthCheckConfig{Enabled: true, Interval: "1h", Timeout: "10s"}
+	lb := newTestLoadBalancer(t, conf)
+
+	done := make(chan error, 1)
+	go func() { done <- lb.AddBackend("web", slow.URL, 0, nil) }()
+	<-checked
+	served := make(chan *Service, 1)
+	go func() { served <- lb.MatchService("/") }()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("requests held up by the health check of a new backend")
+	}
+	release <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateConfigRejectsBusyListener(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	lb := newTestLoadBalancer(t, webConfig())
+	saved := false
+	save := saveFunc(func(config.ConfigType) error {
+		saved = true
+		return nil
+	})
+
+	svc := config.TCPServiceType{Name: "db", Listen: busy.Addr().String(), Backends: []string{"127.0.0.1:5432"}}
+	if err := lb.PutTCPService(svc, save); err == nil {
+		t.Fatal("TCP service on a busy address added")
+	}
+	if saved {
+		t.Error("config saved for a TCP service that cannot listen")
+	}
+	if n := len(lb.Config().TCPServices); n != 0 {
+		t.Errorf("TCP services in config = %d, want 0", n)
+	}
+	if n := len(lb.TCPProxies); n != 0 {
+		t.Errorf("TCP proxies = %d, want 0", n)
+	}
+}
+
+func TestUpdateConfigRestoresRemovedListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	conf := webConfig()
+	conf.TCPServices = []config.TCPServiceType{{Name: "db", Listen: addr, Backends: []string{"127.0.0.1:5432"}}}
+	lb := newTestLoadBalancer(t, conf)
+
+	// The removed listener is closed before the config is restored, which binds it again.
+	failed := saveFunc(func(config.ConfigType) error { return errors.New("disk full") })
+	if err := lb.DeleteService("db", failed); !errors.Is(err, errNotSaved) {
+		t.Fatalf("error = %v, want errNotSaved", err)
+	}
+	if _, ok := lb.TCPProxies[addr]; !ok {
+		t.Fatal("TCP service not restored after the save failed")
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("restored TCP service not listening: %v", err)
+	}
+	c.Close()
+}
+
+func TestMatchService(t *testing.T) {
+	lb := newTestLoadBalancer(t, config.ConfigType{Services: []config.ServiceType{
+		{Name: "root", UrlPath: "/", Backends: []string{"http://a"}},
+		{Name: "api", UrlPath: "/api/", Backends: []string{"http://a"}},
+		{Name: "v2", UrlPath: "/api/v2/", Backends: []string{"http://a"}},
+		{Name: "health", UrlPath: "/health", Backends: []string{"http://a"}},
+	}})
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "root"},
+		{"/index.html", "root"},
+		{"/api/", "api"},
+		{"/api/users", "api"},
+		{"/api/v2/users", "v2"},
+		{"/api/v2", "api"},
+		{"/health", "health"},
+		{"/health/live", "root"},
+	}
+	for _, tt := range tests {
+		if got := lb.MatchService(tt.path); got == nil || got.Name != tt.want {
+			t.Errorf("MatchService(%q) = %v, want %s", tt.path, got, tt.want)
+		}
+	}
+
+	lb = newTestLoadBalancer(t, config.ConfigType{Services: []config.ServiceType{
+		{Name: "api", UrlPath: "/api/", Backends: []string{"http://a"}},
+	}})
+	if got := lb.MatchService("/other"); got != nil {
+		t.Errorf("MatchService(%q) = %s, want nil", "/other", got.Name)
+	}
+}
+
+func TestCheckUnique(t *testing.T) {
+	web := config.ServiceType{Name: "web", UrlPath: "/"}
+	tests := []struct {
+		name string
+		conf config.ConfigType
+		ok   bool
+	}{
+		{"unique", config.ConfigType{
+			Services:    []config.ServiceType{web, {Name: "api", UrlPath: "/api/"}},
+			TCPServices: []config.TCPServiceType{{Name: "dns-tcp", Listen: ":53"}},
+			UDPServices: []config.UDPServiceType{{Name: "dns-udp", Listen: ":53"}},
+		}, true},
+		{"no name", config.ConfigType{Services: []config.ServiceType{{UrlPath: "/"}}}, false},
+		{"same name", config.ConfigType{Services: []config.ServiceType{web, {Name: "web", UrlPath: "/api/"}}}, false},
+		{"same name across protocols", config.ConfigType{
+			Services:    []config.ServiceType{web},
+			TCPServices: []config.TCPServiceType{{Name: "web", Listen: ":80"}},
+		}, false},
+		{"same endpoint", config.ConfigType{Services: []config.ServiceType{web, {Name: "api", UrlPath: "/"}}}, false},
+		{"same TCP listen", config.ConfigType{TCPServices: []config.TCPServiceType{{Name: "a", Listen: ":53"}, {Name: "b", Listen: ":53"}}}, false},
+		{"same UDP listen", config.ConfigType{UDPServices: []config.UDPServiceType{{Name: "a", Listen: ":53"}, {Name: "b", Listen: ":53"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkUnique(&tt.conf); (err == nil) != tt.ok {
+				t.Errorf("checkUnique() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCloneConfig(t *testing.T) {
+	conf := config.ConfigType{
+		Services:    []config.ServiceType{{Name: "web", Backends: []string{"http://a"}, Weights: map[string]int{"http://a": 2}}},
+		TCPServices: []config.TCPServiceType{{Name: "db", Backends: []string{"db:5432"}}},
+		UDPServices: []config.UDPServiceType{{Name: "dns", Backends: []string{"dns:53"}}},
+	}
+	c := cloneConfig(&conf)
+	c.Services[0].Name = "api"
+	c.Services[0].Backends[0] = "http://b"
+	c.Services[0].Weights["http://a"] = 5
+	c.TCPServices[0].Backends[0] = "db2:5432"
+	c.UDPServices[0].Backends[0] = "dns2:53"
+	c.Services = append(c.Services, config.ServiceType{Name: "extra"})
+
+	if s := conf.Services; len(s) != 1 || s[0].Name != "web" || s[0].Backends[0] != "http://a" || s[0].Weights["http://a"] != 2 {
+		t.Errorf("services of the original changed: %+v", s)
+	}
+	if b := conf.TCPServices[0].Backends[0]; b != "db:5432" {
+		t.Errorf("TCP backend of the original = %s, want db:5432", b)
+	}
+	if b := conf.UDPServices[0].Backends[0]; b != "dns:53" {
+		t.Errorf("UDP backend of the original = %s, want dns:53", b)
+	}
+}
+
+func TestPanicModeGaugeAcrossChanges(t *testing.T) {
+	conf := webConfig()
+	conf.Services[0].PanicThreshold = 100
+	lb := newTestLoadBalancer(t, conf)
+	svc := lb.GetServices("/")
+	svc.setAlive(svc.Backends[0], false)
+	svc.UpdateHashRing()
+	if !strings.Contains(scrapeMetrics(), `service_panic_mode{service="web"} 1`) {
+		t.Fatal("service not in panic mode")
+	}
+
+	// Without a threshold, the rebuilt service does not panic.
+	if err := lb.UpdateConfig(func(conf *config.ConfigType) error {
+		conf.Services[0].PanicThreshold = 0
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(scrapeMetrics(), `service_panic_mode{service="web"} 0`) {
+		t.Error("panic mode gauge not reset when the threshold was removed")
+	}
+
+	if err := lb.UpdateConfig(func(conf *config.ConfigType) error {
+		conf.Services[0].Name = "www"
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(scrapeMetrics(), `service_panic_mode{service="web"}`) {
+		t.Error("panic mode gauge kept for a removed service")
+	}
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+// Defaults of the adaptive concurrency limiter.
+const (
+	defaultConcurrencyInitialLimit = 20
+	defaultConcurrencyMinLimit     = 1
+	defaultConcurrencyMaxLimit     = 1000
+	defaultConcurrencyLatency      = time.Second
+)
+
+// Tuning of the limit algorithms, after Netflix's concurrency-limits.
+const (
+	aimdBackoff        = 0.9   // AIMD: multiplicative decrease on overload.
+	gradientTolerance  = 1.5   // Gradient: latency increase tolerated before backing off.
+	gradientSmoothing  = 0.2   // Gradient: weight of a new limit estimate.
+	gradientShortAlpha = 0.1   // Gradient: EWMA weight of the short-term latency.
+	gradientLongAlpha  = 0.002 // Gradient: EWMA weight of the long-term (baseline) latency.
+)
+
+// concurrencyLimiter caps the requests a service has in flight at a limit it adapts
+// to the latency the service observes: the limit grows while latency stays flat, and
+// shrinks when it rises, since requests then queue up somewhere behind the balancer.
+// Requests over the limit are shed rather than queued.
+//
+// Requests may carry a priority class. Class i of n may only use (n-i)/n of the limit,
+// so the lowest classes are shed first and the highest keeps the whole limit.
+// A nil *concurrencyLimiter admits every request.
+type concurrencyLimiter struct {
+	service   string
+	algorithm string // "gradient" or "aimd".
+	minLimit  float64
+	maxLimit  float64
+	latency   time.Duration // AIMD: latency above which the limit backs off.
+	header    string        // Header carrying the priority class, if any.
+	classes   []string      // Priority classes, highest first.
+
+	mux          sync.Mutex
+	limit        float64
+	inFlight     int
+	shortLatency float64 // Gradient: recent latency, in seconds.
+	longLatency  float64 // Gradient: baseline latency, in seconds.
+}
+
+// newConcurrencyLimiter builds the adaptive concurrency limiter of a service, or
+// returns nil when it is not enabled.
+func newConcurrencyLimiter(serviceConf config.ServiceType) *concurrencyLimiter {
+	conf := serviceConf.AdaptiveConcurrency
+	if !conf.Enabled {
+		return nil
+	}
+	l := &concurrencyLimiter{
+		service:   serviceConf.Name,
+		algorithm: conf.Algorithm,
+		minLimit:  float64(conf.MinLimit),
+		maxLimit:  float64(conf.MaxLimit),
+		limit:     float64(conf.InitialLimit),
+		latency:   parseTimeout(conf.LatencyThreshold, defaultConcurrencyLatency),
+		header:    conf.PriorityHeader,
+		classes:   conf.PriorityClasses,
+	}
+	if l.algorithm == "" {
+		l.algorithm = "gradient"
+	}
+	if l.minLimit <= 0 {
+		l.minLimit = defaultConcurrencyMinLimit
+	}
+	if l.maxLimit <= 0 {
+		l.maxLimit = defaultConcurrencyMaxLimit
+	}
+	if l.limit <= 0 {
+		l.limit = defaultConcurrencyInitialLimit
+	}
+	l.limit = math.Min(math.Max(l.limit, l.minLimit), l.maxLimit)
+	ConcurrencyLimit.WithLabelValues(l.service).Set(l.limit)
+	return l
+}
+
+// priority returns the index of the priority class of r. Requests without a known
+// class get the lowest one.
+func (l *concurrencyLimiter) priority(r *http.Request) int {
+	if l.header != "" {
+		class := r.Header.Get(l.header)
+		for i, c := range l.classes {
+			if c == class {
+				return i
+			}
+		}
+	}
+	return max(len(l.classes)-1, 0)
+}
+
+// className returns the name of a priority class, used as the "priority" metric label.
+func (l *concurrencyLimiter) className(class int) string {
+	if class < len(l.classes) {
+		return l.classes[class]
+	}
+	return "default"
+}
+
+// acquire admits a request of the priority class if the service has room for it.
+func (l *concurrencyLimiter) acquire(class int) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	limit := l.limit
+	if n := len(l.classes); n > 1 {
+		limit = l.limit * float64(n-class) / float64(n)
+	}
+	if float64(l.inFlight) >= math.Max(limit, 1) {
+		return false
+	}
+	l.inFlight++
+	ConcurrencyInFlight.WithLabelValues(l.service).Set(float64(l.inFlight))
+	return true
+}
+
+// release ends an admitted request, and adapts the limit to its latency and outcome.
+// Streams give no latency sample, as their duration says nothing about load.
+func (l *concurrencyLimiter) release(latency time.Duration, failed, streaming bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	inFlight := l.inFlight
+	l.inFlight--
+	ConcurrencyInFlight.WithLabelValues(l.service).Set(float64(l.inFlight))
+	if streaming {
+		return
+	}
+
+	switch l.algorithm {
+	case "aimd":
+		if failed || latency > l.latency {
+			l.limit *= aimdBackoff
+		} else if float64(inFlight)*2 >= l.limit {
+			// Only grow while the limit is actually in use.
+			l.limit++
+		}
+	default:
+		sample := latency.Seconds()
+		if l.longLatency == 0 {
+			l.shortLatency, l.longLatency = sample, sample
+		}
+		l.shortLatency += gradientShortAlpha * (sample - l.shortLatency)
+		l.longLatency += gradientLongAlpha * (sample - l.longLatency)
+		if l.longLatency > 2*l.shortLatency {
+			// Latency dropped for good (e.g. a slow backend left), let the baseline follow.
+			l.longLatency *= 0.95
+		}
+		if float64(inFlight)*2 < l.limit {
+			return // Not enough load to tell anything about the limit.
+		}
+		gradient := math.Max(0.5, math.Min(1, gradientTolerance*l.longLatency/l.shortLatency))
+		estimate := l.limit*gradient + math.Sqrt(l.limit)
+		l.limit = l.limit*(1-gradientSmoothing) + estimate*gradientSmoothing
+	}
+	l.limit = math.Min(math.Max(l.limit, l.minLimit), l.maxLimit)
+	ConcurrencyLimit.WithLabelValues(l.service).Set(l.limit)
+}
+
+// serveLimited proxies the request within the adaptive concurrency limit of the
+// service, and sheds it with 503 when the limit is reached. Upgraded connections and
+// event streams are not limited, as they stay open for as long as clients want.
+func (s *Service) serveLimited(rw *responseWriter, r *http.Request, start time.Time) {
+	l := s.concurrency
+	if l == nil || isUpgradeRequest(r) || acceptsEventStream(r) {
+		s.proxy(rw, r, start)
+		return
+	}
+
+	class := l.priority(r)
+	if !l.acquire(class) {
+		ShedRequestsTotal.WithLabelValues(s.Name, l.className(class)).Inc()
+		rw.Header().Set("Retry-After", "1")
+		if s.Protocol == "grpc" {
+			writeGrpcError(rw, grpcUnavailable, "load shed")
+		} else {
+			http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+		}
+		return
+	}
+	defer func() {
+		l.release(time.Since(start), s.failed(rw), rw.isStreaming())
+	}()
+	s.proxy(rw, r, start)
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+// Kinds of injected faults, used as the "type" metric label.
+const (
+	faultDelay = "delay"
+	faultAbort = "abort"
+	faultReset = "reset"
+)
+
+// fault is a parsed config.FaultConfig.
+type fault struct {
+	name        string
+	header      string // Header matched, if any.
+	value       string // Value the header must have, if any.
+	percentage  float64
+	delay       time.Duration
+	maxDelay    time.Duration // Delays are random between delay and maxDelay, when set.
+	abortStatus int
+	reset       bool
+}
+
+// faultInjector injects the configured faults into the requests of a service.
+// A nil *faultInjector injects nothing.
+type faultInjector struct {
+	service string
+	faults  []fault
+}
+
+// newFaultInjector builds the fault injector of a service, or returns nil when it has no faults.
+func newFaultInjector(serviceConf config.ServiceType) *faultInjector {
+	if len(serviceConf.Faults) == 0 {
+		return nil
+	}
+	fi := &faultInjector{service: serviceConf.Name}
+	for i, conf := range serviceConf.Faults {
+		f := fault{
+			name:        conf.Name,
+			percentage:  conf.Percentage,
+			delay:       parseTimeout(conf.Delay, 0),
+			maxDelay:    parseTimeout(conf.MaxDelay, 0),
+			abortStatus: conf.AbortStatus,
+			reset:       conf.Reset,
+		}
+		if f.name == "" {
+			f.name = "fault-" + strconv.Itoa(i)
+		}
+		if conf.Header != "" {
+			name, value, _ := strings.Cut(conf.Header, ":")
+			f.header, f.value = strings.TrimSpace(name), strings.TrimSpace(value)
+			if f.percentage == 0 {
+				f.percentage = 100
+			}
+		}
+		fi.faults = append(fi.faults, f)
+	}
+	return fi
+}
+
+// matches reports whether the fault applies to r.
+func (f *fault) matches(r *http.Request) bool {
+	if f.header != "" {
+		values, ok := r.Header[http.CanonicalHeaderKey(f.header)]
+		if !ok || (f.value != "" && !strings.EqualFold(strings.Join(values, ","), f.value)) {
+			return false
+		}
+	}
+	return f.percentage >= 100 || rand.Float64()*100 < f.percentage
+}
+
+// inject applies the first fault matching r, and returns false when the request got
+// aborted, or its client went away during the delay. Reset faults do not return: they
+// abort the handler, which drops the connection (or resets the HTTP/2 stream), and
+// leave the status code of rw at 0.
+func (fi *faultInjector) inject(rw *responseWriter, r *http.Request, grpc bool) bool {
+	if fi == nil {
+		return true
+	}
+	for i := range fi.faults {
+		f := &fi.faults[i]
+		if !f.matches(r) {
+			continue
+		}
+		if f.delay > 0 {
+			delay := f.delay
+			if f.maxDelay > f.delay {
+				delay += rand.N(f.maxDelay - f.delay)
+			}
+			FaultsInjectedTotal.WithLabelValues(fi.service, f.name, faultDelay).Inc()
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return false
+			}
+		}
+		switch {
+		case f.reset:
+			FaultsInjectedTotal.WithLabelValues(fi.service, f.name, faultReset).Inc()
+			rw.statusCode = 0 // Nothing is answered.
+			panic(http.ErrAbortHandler)
+		case f.abortStatus != 0:
+			FaultsInjectedTotal.WithLabelValues(fi.service, f.name, faultAbort).Inc()
+			if grpc {
+				writeGrpcError(rw, grpcUnavailable, "fault injected")
+			} else {
+				http.Error(rw, http.StatusText(f.abortStatus), f.abortStatus)
+			}
+			return false
+		}
+		return true
+	}
+	return true
+}
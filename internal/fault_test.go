@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+func TestFaultMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		conf   config.FaultConfig
+		header string // Value of X-Fault, if set.
+		want   bool
+	}{
+		{"every request", config.FaultConfig{Percentage: 100}, "", true},
+		{"no request", config.FaultConfig{}, "", false},
+		{"header present", config.FaultConfig{Header: "X-Fault"}, "on", true},
+		{"header missing", config.FaultConfig{Header: "X-Fault"}, "", false},
+		{"header value", config.FaultConfig{Header: "X-Fault: On"}, "on", true},
+		{"other header value", config.FaultConfig{Header: "X-Fault: on"}, "off", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fi := newFaultInjector(config.ServiceType{Name: t.Name(), Faults: []config.FaultConfig{tt.conf}})
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Fault", tt.header)
+			}
+			if got := fi.faults[0].matches(r); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFaultInjectAbort(t *testing.T) {
+	fi := newFaultInjector(config.ServiceType{Name: t.Name(), Faults: []config.FaultConfig{
+		{Header: "X-Other", AbortStatus: http.StatusTeapot},
+		{Percentage: 100, AbortStatus: http.StatusServiceUnavailable},
+	}})
+	if fi.faults[1].name != "fault-1" {
+		t.Errorf("default name = %q, want fault-1", fi.faults[1].name)
+	}
+
+	w := httptest.NewRecorder()
+	if fi.inject(newResponseWriter(w), httptest.NewRequest(http.MethodGet, "/", nil), false) {
+		t.Fatal("inject() = true for an aborted request")
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	w = httptest.NewRecorder()
+	fi.inject(newResponseWriter(w), httptest.NewRequest(http.MethodGet, "/", nil), true)
+	if w.Code != http.StatusOK || w.Header().Get("Grpc-Status") != "14" {
+		t.Errorf("gRPC abort: status %d, grpc-status %q, want 200 and 14", w.Code, w.Header().Get("Grpc-Status"))
+	}
+}
+
+func TestFaultResetRecordsMetrics(t *testing.T) {
+	s := newTestService(t, config.ServiceType{Faults: []config.FaultConfig{{Percentage: 100, Reset: true}}})
+	func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Errorf("panic = %v, want http.ErrAbortHandler", p)
+			}
+		}()
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/reset", nil))
+	}()
+
+	want := `http_requests_total{code="0",method="GET",path="/reset",service="` + s.Name + `"} 1`
+	if !strings.Contains(scrapeMetrics(), want) {
+		t.Errorf("metrics do not contain %s", want)
+	}
+}
+
+// scrapeMetrics returns the metrics as Prometheus would scrape them.
+func scrapeMetrics() string {
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	metrics, _ := io.ReadAll(w.Body)
+	return string(metrics)
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// gRPC status codes used by the load balancer itself.
+const (
+	grpcOK                = 0
+	grpcDeadlineExceeded  = 4
+	grpcResourceExhausted = 8
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+)
+
+// grpcCodeNames maps gRPC status codes to their canonical names, used as the "code" metric label.
+var grpcCodeNames = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND",
+	"ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION",
+	"ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED", "INTERNAL", "UNAVAILABLE", "DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+// grpcHealthServing is the SERVING value of grpc.health.v1.HealthCheckResponse.ServingStatus.
+const grpcHealthServing = 1
+
+// useGrpcProtocols makes the transport always speak HTTP/2 to the backend: h2c
+// with prior knowledge for http:// backends and h2 over TLS for https:// ones.
+// Every RPC becomes its own stream, so each one is balanced and counted on its own.
+func useGrpcProtocols(t *http.Transport) {
+	t.Protocols = new(http.Protocols)
+	t.Protocols.SetHTTP2(true)
+	t.Protocols.SetUnencryptedHTTP2(true)
+}
+
+// writeGrpcError writes a Trailers-Only gRPC response carrying the given status.
+func writeGrpcError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", msg)
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcStatus returns the grpc-status sent by the backend, looking at the trailers
+// first and at the headers for Trailers-Only responses.
+func grpcStatus(h http.Header) (string, bool) {
+	for _, key := range []string{"Grpc-Status", http.TrailerPrefix + "Grpc-Status"} {
+		if v := h.Get(key); v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// grpcCodeLabel converts a grpc-status value into its canonical name.
+func grpcCodeLabel(status string) string {
+	code, err := strconv.Atoi(status)
+	if err != nil || code < 0 || code >= len(grpcCodeNames) {
+		return status
+	}
+	return grpcCodeNames[code]
+}
+
+// grpcHealthChecker calls grpc.health.v1.Health/Check on backends.
+type grpcHealthChecker struct {
+	healthTarget
+	service string // Empty checks the whole server.
+}
+
+// alive reports whether the backend says the service is SERVING.
+func (hc *grpcHealthChecker) alive(b *Backend) bool {
+	client := hc.client(b)
+	target := hc.base(b) + "/grpc.health.v1.Health/Check"
+	service := hc.service
+
+	// HealthCheckRequest{service = 1} wrapped in an uncompressed gRPC message frame.
+	msg := binary.AppendUvarint([]byte{0x0a}, uint64(len(service)))
+	msg = append(msg, service...)
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(frame))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return false
+	}
+	// Trailers are only populated once the body has been read.
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != strconv.Itoa(grpcOK) || len(body) < 5 || body[0] != 0 {
+		return false
+	}
+	return parseServingStatus(body[5:]) == grpcHealthServing
+}
+
+// parseServingStatus extracts field 1 (status) from an encoded HealthCheckResponse.
+func parseServingStatus(msg []byte) uint64 {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0
+		}
+		msg = msg[n:]
+		switch key & 7 {
+		case 0: // varint
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0
+			}
+			if key>>3 == 1 {
+				return v
+			}
+			msg = msg[n:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return 0
+			}
+			msg = msg[n+int(l):]
+		default:
+			return 0
+		}
+	}
+	return 0
+}
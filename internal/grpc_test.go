@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+func TestParseServingStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+		want uint64
+	}{
+		{"serving", []byte{0x08, 0x01}, grpcHealthServing},
+		{"not serving", []byte{0x08, 0x02}, 2},
+		{"empty", nil, 0},
+		{"unknown fields skipped", []byte{0x12, 0x02, 'h', 'i', 0x18, 0x05, 0x08, 0x01}, grpcHealthServing},
+		{"truncated field", []byte{0x12, 0x05, 'h'}, 0},
+		{"truncated varint", []byte{0x08, 0x80}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseServingStatus(tt.msg); got != tt.want {
+				t.Errorf("parseServingStatus(%x) = %d, want %d", tt.msg, got, tt.want)
+			}
+		})
+	}
+}
+
+// newGrpcHealthServer starts an h2c server answering gRPC health checks with status.
+func newGrpcHealthServer(t *testing.T, status byte) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != "/grpc.health.v1.Health/Check" {
+			http.Error(w, "not a gRPC health check", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0, 0, 0, 0, 2, 0x08, status})
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGrpcHealthCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		status   byte
+		want     bool
+	}{
+		{"grpc service", "grpc", grpcHealthServing, true},
+		{"http service", "http", grpcHealthServing, true},
+		{"not serving", "http", 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newGrpcHealthServer(t, tt.status)
+			s := newTestService(t, config.ServiceType{
+				UrlPath:     "/grpc.health.v1.Health/",
+				Protocol:    tt.protocol,
+				Backends:    []string{srv.URL},
+				HealthCheck: config.HealthCheckConfig{Type: "grpc"},
+			})
+			if got := s.healthChecker.alive(s.Backends[0]); got != tt.want {
+				t.Errorf("alive() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+	"github.com/vinit-chauhan/load-balancer/logger"
+)
+
+// Defaults of active health checks.
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthyThreshold    = 2
+	defaultUnhealthyThreshold  = 3
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultMaxConcurrentProbes = 64
+	healthCheckMaxBody         = 1 << 16 // Bytes of the response body matched, at most.
+)
+
+// defaultHealthyStatuses are the statuses of healthy backends when none are configured:
+// anything showing the server is up and answering, client errors included.
+var defaultHealthyStatuses = []statusRange{{200, 499}}
+
+// statusRange is an inclusive range of HTTP status codes.
+type statusRange struct {
+	lo, hi int
+}
+
+// healthChecker runs the active health checks of the backends of a service.
+type healthChecker interface {
+	// alive checks the backend once, and reports whether it is healthy.
+	alive(b *Backend) bool
+}
+
+// newHealthChecker builds the health checker of a service speaking protocol, picked by
+// the type of the check, which defaults to the protocol of the service.
+func newHealthChecker(conf config.HealthCheckConfig, protocol string) healthChecker {
+	target := healthTarget{timeout: parseTimeout(conf.Timeout, defaultHealthCheckTimeout)}
+	if conf.Port != 0 {
+		target.port = strconv.Itoa(conf.Port)
+	}
+	kind := conf.Type
+	if kind == "" {
+		kind = protocol
+	}
+	switch kind {
+	case "tcp":
+		return &tcpHealthChecker{healthTarget: target}
+	case "grpc":
+		return &grpcHealthChecker{healthTarget: target, service: conf.Service}
+	case "exec":
+		return &execHealthChecker{healthTarget: target, command: conf.Command}
+	default:
+		return newHTTPHealthChecker(conf, target)
+	}
+}
+
+// healthTarget says where and how long health checks of a backend may take.
+type healthTarget struct {
+	timeout time.Duration
+	port    string // Empty checks the port the traffic goes to.
+}
+
+// client returns an HTTP client going through the health check pool of the backend,
+// which knows its TLS settings and how to reach Unix sockets.
+func (t healthTarget) client(b *Backend) *http.Client {
+	return &http.Client{
+		Transport: b.checkPool,
+		Timeout:   t.timeout,
+	}
+}
+
+// base returns the scheme and host HTTP health checks of the backend are sent to.
+func (t healthTarget) base(b *Backend) string {
+	if t.port == "" || b.socketPath != "" {
+		return b.httpBase()
+	}
+	return b.URL.Scheme + "://" + net.JoinHostPort(b.URL.Hostname(), t.port)
+}
+
+// address returns the network and address health checks of the backend connect to.
+func (t healthTarget) address(b *Backend) (network, address string) {
+	if b.socketPath != "" {
+		return "unix", b.socketPath
+	}
+	if t.port != "" {
+		return "tcp", net.JoinHostPort(b.URL.Hostname(), t.port)
+	}
+	return "tcp", b.URL.Host
+}
+
+// httpHealthChecker sends HTTP requests, and checks the status and body of the responses.
+type httpHealthChecker struct {
+	healthTarget
+	path         string
+	method       string // Empty sends HEAD, then GET if HEAD fails.
+	statuses     []statusRange
+	bodyContains string
+	bodyRegex    *regexp.Regexp
+	headers      map[string]string
+	host         string
+}
+
+// newHTTPHealthChecker parses the HTTP settings of a validated health check configuration.
+func newHTTPHealthChecker(conf config.HealthCheckConfig, target healthTarget) *httpHealthChecker {
+	hc := &httpHealthChecker{
+		healthTarget: target,
+		path:         conf.Path,
+		method:       strings.ToUpper(conf.Method),
+		bodyContains: conf.BodyContains,
+		headers:      conf.Headers,
+		host:         conf.Host,
+	}
+	for _, s := range conf.ExpectedStatus {
+		lo, hi, _ := config.ParseStatusRange(s)
+		hc.statuses = append(hc.statuses, statusRange{lo, hi})
+	}
+	if len(hc.statuses) == 0 {
+		hc.statuses = defaultHealthyStatuses
+	}
+	if conf.BodyRegex != "" {
+		hc.bodyRegex = regexp.MustCompile(conf.BodyRegex)
+	}
+	if hc.method == "" && (hc.bodyContains != "" || hc.bodyRegex != nil) {
+		hc.method = http.MethodGet // HEAD responses have no body to match.
+	}
+	return hc
+}
+
+// alive sends an HTTP health check to the backend, and reports whether its response
+// has an expected status and body.
+func (hc *httpHealthChecker) alive(b *Backend) bool {
+	client := hc.client(b)
+	target := hc.base(b) + hc.path
+
+	var resp *http.Response
+	var err error
+	if hc.method == "" {
+		// Attempt a HEAD request first, as it's generally lighter.
+		if resp, err = hc.do(client, http.MethodHead, target); err != nil {
+			// If HEAD fails, fallback to a GET request.
+			resp, err = hc.do(client, http.MethodGet, target)
+		}
+	} else {
+		resp, err = hc.do(client, hc.method, target)
+	}
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if !hc.expectedStatus(resp.StatusCode) {
+		return false
+	}
+	if hc.bodyContains == "" && hc.bodyRegex == nil {
+		return true
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, healthCheckMaxBody))
+	if err != nil {
+		return false
+	}
+	if hc.bodyContains != "" && !strings.Contains(string(body), hc.bodyContains) {
+		return false
+	}
+	return hc.bodyRegex == nil || hc.bodyRegex.Match(body)
+}
+
+// do sends a health check request with the configured headers and Host.
+func (hc *httpHealthChecker) do(client *http.Client, method, target string) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range hc.headers {
+		req.Header.Set(name, value)
+	}
+	if hc.host != "" {
+		req.Host = hc.host
+	}
+	return client.Do(req)
+}
+
+// expectedStatus reports whether a health check response status means healthy.
+func (hc *httpHealthChecker) expectedStatus(code int) bool {
+	for _, r := range hc.statuses {
+		if code >= r.lo && code <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// execHealthChecker runs a local command, which gets the backend in its environment
+// (BACKEND_URL, BACKEND_HOST and BACKEND_PORT). Exiting with 0 means healthy.
+type execHealthChecker struct {
+	healthTarget
+	command []string
+}
+
+func (hc *execHealthChecker) alive(b *Backend) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, hc.command[0], hc.command[1:]...)
+	// Do not wait for output held open by children of a killed command.
+	cmd.WaitDelay = time.Second
+
+	_, address := hc.address(b)
+	host, port, _ := net.SplitHostPort(address)
+	cmd.Env = append(os.Environ(),
+		"BACKEND_URL="+b.URL.String(),
+		"BACKEND_HOST="+host,
+		"BACKEND_PORT="+port,
+	)
+	if err := cmd.Run(); err != nil {
+		logger.Debug("HealthCheck", "health check command failed", "backend", b.URL.String(), "error", err)
+		return false
+	}
+	return true
+}
+
+// healthProbes bounds the health checks in flight across all services.
+var healthProbes = &probeLimiter{slots: make(chan struct{}, defaultMaxConcurrentProbes)}
+
+// probeLimiter hands out a bounded number of probe slots. It can be resized on config
+// reloads; probes running meanwhile give their slot back to the old pool.
+type probeLimiter struct {
+	mux   sync.RWMutex
+	slots chan struct{}
+}
+
+// resize changes the number of slots, 0 meaning the default.
+func (l *probeLimiter) resize(n int) {
+	if n <= 0 {
+		n = defaultMaxConcurrentProbes
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if cap(l.slots) != n {
+		l.slots = make(chan struct{}, n)
+	}
+}
+
+// acquire waits for a slot, and returns the func giving it back. It returns false
+// when stop is closed first.
+func (l *probeLimiter) acquire(stop <-chan struct{}) (func(), bool) {
+	l.mux.RLock()
+	slots := l.slots
+	l.mux.RUnlock()
+	select {
+	case slots <- struct{}{}:
+		HealthChecksInFlight.Inc()
+		return func() {
+			HealthChecksInFlight.Dec()
+			<-slots
+		}, true
+	case <-stop:
+		return nil, false
+	}
+}
+
+// healthPolicy says when backends are checked, and how many consecutive results
+// change their status.
+type healthPolicy struct {
+	interval           time.Duration
+	unhealthyInterval  time.Duration // Interval while the backend is down.
+	jitter             time.Duration // Upper bound of the random delay added to intervals.
+	healthyThreshold   int
+	unhealthyThreshold int
+}
+
+// newHealthPolicy parses the scheduling settings of a validated health check configuration.
+func newHealthPolicy(conf config.HealthCheckConfig) healthPolicy {
+	p := healthPolicy{
+		interval:           parseTimeout(conf.Interval, defaultHealthCheckInterval),
+		healthyThreshold:   conf.HealthyThreshold,
+		unhealthyThreshold: conf.UnhealthyThreshold,
+	}
+	if p.interval <= 0 {
+		p.interval = defaultHealthCheckInterval
+	}
+	p.unhealthyInterval = parseTimeout(conf.UnhealthyInterval, p.interval)
+	p.jitter = parseTimeout(conf.Jitter, p.interval/10)
+	if p.healthyThreshold == 0 {
+		p.healthyThreshold = defaultHealthyThreshold
+	}
+	if p.unhealthyThreshold == 0 {
+		p.unhealthyThreshold = defaultUnhealthyThreshold
+	}
+	return p
+}
+
+// next returns the delay until the next check of a backend.
+func (p healthPolicy) next(alive bool) time.Duration {
+	d := p.interval
+	if !alive {
+		d = p.unhealthyInterval
+	}
+	if p.jitter > 0 {
+		d += rand.N(p.jitter)
+	}
+	return d
+}
+
+// healthCheckLoop checks the backend periodically until the service is stopped, and
+// changes its status once enough consecutive checks disagree with it.
+func (s *Service) healthCheckLoop(b *Backend, p healthPolicy) {
+	// Start at a random point of the interval, so the checks of the backends of all
+	// services spread out over it.
+	timer := time.NewTimer(rand.N(p.interval))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-s.stop:
+			return
+		}
+		alive := s.probe(b)
+		if s.stopped() {
+			return // The service replacing it may share the backend, and checks it now.
+		}
+		if s.recordProbe(b, alive, p) {
+			s.UpdateHashRing()
+		}
+		timer.Reset(p.next(b.IsAlive()))
+	}
+}
+
+// recordProbe counts the result of a health check of the backend, and reports whether
+// it changed the status of the backend.
+func (s *Service) recordProbe(b *Backend, alive bool, p healthPolicy) bool {
+	b.healthMux.Lock()
+	defer b.healthMux.Unlock()
+	if alive {
+		b.healthOK, b.healthFailed = b.healthOK+1, 0
+	} else {
+		b.healthOK, b.healthFailed = 0, b.healthFailed+1
+	}
+	wasAlive := b.IsAlive()
+	if (alive && !wasAlive && b.healthOK >= p.healthyThreshold) ||
+		(!alive && wasAlive && b.healthFailed >= p.unhealthyThreshold) {
+		s.setAlive(b, alive)
+		return true
+	}
+	return false
+}
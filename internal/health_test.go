@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+func TestExpectedStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected []string
+		code     int
+		want     bool
+	}{
+		{"default success", nil, http.StatusOK, true},
+		{"default client error", nil, http.StatusNotFound, true},
+		{"default server error", nil, http.StatusServiceUnavailable, false},
+		{"code", []string{"204"}, http.StatusNoContent, true},
+		{"other code", []string{"204"}, http.StatusOK, false},
+		{"range", []string{"200-299"}, http.StatusAccepted, true},
+		{"range end", []string{"200-299"}, 299, true},
+		{"past range", []string{"200-299"}, http.StatusMultipleChoices, false},
+		{"second entry", []string{"200", "301-302"}, http.StatusFound, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc := newHTTPHealthChecker(config.HealthCheckConfig{ExpectedStatus: tt.expected}, healthTarget{})
+			if got := hc.expectedStatus(tt.code); got != tt.want {
+				t.Errorf("expectedStatus(%d) = %v, want %v", tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPHealthCheck(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Check") != "yes" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name string
+		conf config.HealthCheckConfig
+		want bool
+	}{
+		{"status", config.HealthCheckConfig{Headers: map[string]string{"X-Check": "yes"}, ExpectedStatus: []string{"200"}}, true},
+		{"unexpected status", config.HealthCheckConfig{ExpectedStatus: []string{"200"}}, false},
+		{"body", config.HealthCheckConfig{Headers: map[string]string{"X-Check": "yes"}, BodyContains: `"ok"`}, true},
+		{"body mismatch", config.HealthCheckConfig{Headers: map[string]string{"X-Check": "yes"}, BodyContains: "down"}, false},
+		{"body regex", config.HealthCheckConfig{Headers: map[string]string{"X-Check": "yes"}, BodyRegex: `"status":\s*"ok"`}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf.Enabled = true
+			s := newTestService(t, config.ServiceType{Backends: []string{backend.URL}, HealthCheck: tt.conf})
+			if got := s.healthChecker.alive(s.Backends[0]); got != tt.want {
+				t.Errorf("alive() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordProbe(t *testing.T) {
+	p := healthPolicy{healthyThreshold: 2, unhealthyThreshold: 3}
+	tests := []struct {
+		name   string
+		alive  bool   // Status before the probes.
+		probes string // Probe results: "+" passed, "-" failed.
+		want   string // Status after each probe: "u" up, "d" down; upper case when it changed.
+	}{
+		{"up stays up", true, "+++", "uuu"},
+		{"falls after threshold", true, "---", "uuD"},
+		{"fall interrupted", true, "--+--", "uuuuu"},
+		{"stays down", false, "---", "ddd"},
+		{"rises after threshold", false, "++", "dU"},
+		{"rise interrupted", false, "+-+", "ddd"},
+		{"flaps back", true, "---++", "uuDdU"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, config.ServiceType{Backends: []string{"http://a"}})
+			b := s.Backends[0]
+			b.SetAlive(tt.alive)
+			got := ""
+			for _, probe := range tt.probes {
+				changed := s.recordProbe(b, probe == '+', p)
+				status := "d"
+				if b.IsAlive() {
+					status = "u"
+				}
+				if changed {
+					status = strings.ToUpper(status)
+				}
+				got += status
+			}
+			if got != tt.want {
+				t.Errorf("statuses = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthCheckLoopStopsBeforeRecording(t *testing.T) {
+	var checks atomic.Int32
+	probing := make(chan struct{}, 1)
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if checks.Add(1) == 1 {
+			return // The initial check passes.
+		}
+		select {
+		case probing <- struct{}{}:
+		default:
+		}
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	s := newTestService(t, config.ServiceType{Backends: []string{backend.URL}, HealthCheck: config.HealthCheckConfig{
+		Enabled: true, Interval: "10ms", UnhealthyThreshold: 1, Timeout: "5s",
+	}})
+	b := s.Backends[0]
+	<-probing
+	// The service is replaced while its check is in flight: the one replacing it may
+	// keep the backend, and own its status now.
+	s.Stop()
+	release <- struct{}{}
+	time.Sleep(50 * time.Millisecond)
+	b.healthMux.Lock()
+	failed := b.healthFailed
+	b.healthMux.Unlock()
+	if failed != 0 || !b.IsAlive() {
+		t.Errorf("failed checks = %d, alive = %v after the service stopped; want 0 and alive", failed, b.IsAlive())
+	}
+}
@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+// Defaults and tuning of request hedging.
+const (
+	defaultHedgeBudget   = 0.1 // Hedges allowed per request.
+	hedgeBudgetMax       = 10  // Hedges that may be saved up while traffic is calm.
+	hedgeLatencySamples  = 512 // Response header latencies kept for "p95" delays.
+	hedgeMinSamples      = 20  // Samples needed before "p95" delays hedge at all.
+	hedgePercentileEvery = 64  // Samples between two computations of the p95.
+)
+
+// Outcomes of hedged requests, used as the "outcome" metric label.
+const (
+	hedgeOutcomeWon    = "won"    // The hedge answered first.
+	hedgeOutcomeLost   = "lost"   // The original request answered first.
+	hedgeOutcomeDenied = "denied" // The budget was exhausted, no hedge was sent.
+)
+
+// hedger sends a duplicate of slow GET requests to a second backend, and uses whichever
+// answers first. A nil *hedger never hedges.
+type hedger struct {
+	service string
+	delay   time.Duration // Fixed delay, 0 when it follows the p95 latency.
+	budget  float64       // Hedges earned per request.
+
+	mux     sync.Mutex
+	tokens  float64                      // Hedges currently allowed.
+	samples [hedgeLatencySamples]float64 // Ring of response header latencies, in seconds.
+	count   int                          // Samples recorded so far.
+	p95     time.Duration                // Cached percentile, refreshed every hedgePercentileEvery samples.
+}
+
+// newHedger builds the hedger of a service, or returns nil when hedging is off.
+func newHedger(serviceConf config.ServiceType) *hedger {
+	conf := serviceConf.Hedging
+	if !conf.Enabled {
+		return nil
+	}
+	h := &hedger{
+		service: serviceConf.Name,
+		budget:  conf.BudgetPercent / 100,
+		tokens:  hedgeBudgetMax,
+	}
+	if conf.Delay != "p95" {
+		h.delay = parseTimeout(conf.Delay, 0)
+	}
+	if h.budget <= 0 {
+		h.budget = defaultHedgeBudget
+	}
+	return h
+}
+
+// hedgeDelay returns how long to wait for response headers before hedging, and false
+// when there are not enough samples yet to derive it.
+func (h *hedger) hedgeDelay() (time.Duration, bool) {
+	if h.delay > 0 {
+		return h.delay, true
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.p95, h.count >= hedgeMinSamples
+}
+
+// observe records the response header latency of a request.
+func (h *hedger) observe(latency time.Duration) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.samples[h.count%hedgeLatencySamples] = latency.Seconds()
+	h.count++
+	if h.count == hedgeMinSamples || h.count%hedgePercentileEvery == 0 {
+		sorted := slices.Clone(h.samples[:min(h.count, hedgeLatencySamples)])
+		slices.Sort(sorted)
+		h.p95 = time.Duration(sorted[len(sorted)*95/100] * float64(time.Second))
+	}
+}
+
+// earn adds the hedge budget earned by a request.
+func (h *hedger) earn() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.tokens = min(h.tokens+h.budget, hedgeBudgetMax)
+}
+
+// spend takes a hedge from the budget, if there is one left.
+func (h *hedger) spend() bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// hedgeResult is the outcome of one of the attempts of a hedged request.
+type hedgeResult struct {
+	resp    *http.Response
+	err     error
+	hedge   bool
+	latency time.Duration // Until the response headers came.
+}
+
+// hedgedRoundTrip sends the request to the first backend through base, and a copy to
+// another backend if no response headers came after the hedge delay. The first
+// successful response is returned; the other attempt is canceled.
+func (ur *upstreamRequest) hedgedRoundTrip(base http.RoundTripper, req *http.Request) (*http.Response, error) {
+	h := ur.service.hedger
+
+	// Each attempt is released, i.e. canceled and its backend slot freed, when it fails,
+	// loses, or once the body of its response is closed. Indexed by hedgeResult.hedge.
+	var release [2]func()
+	results := make(chan hedgeResult, 2)
+	attempt := func(rt http.RoundTripper, r *http.Request, hedge bool) {
+		go func() {
+			start := time.Now()
+			resp, err := rt.RoundTrip(r)
+			if err == nil {
+				h.observe(time.Since(start))
+			}
+			results <- hedgeResult{resp: resp, err: err, hedge: hedge, latency: time.Since(start)}
+		}()
+	}
+	// settle tells the circuit breaker of the backend of an attempt how it ended. The
+	// service does it for the first backend, unless it was settled here.
+	var other *Backend
+	settle := func(hedge, canceled, failed bool, latency time.Duration) {
+		b := ur.primary
+		if hedge {
+			b = other
+		} else {
+			ur.primaryRecorded = true
+		}
+		if canceled {
+			b.breaker.release()
+		} else {
+			b.breaker.record(failed, latency)
+		}
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	release[0] = sync.OnceFunc(cancel)
+	attempt(base, req.WithContext(ctx), false)
+	pending, hedged := 1, false
+
+	var timer <-chan time.Time
+	if delay, ok := h.hedgeDelay(); ok {
+		timer = time.After(delay)
+	}
+	for {
+		select {
+		case <-timer:
+			timer = nil
+			other = ur.service.acquireOther(ur.inbound, []*Backend{ur.primary})
+			if other == nil {
+				continue
+			}
+			if !h.spend() {
+				ur.service.releaseBackend(other)
+				HedgedRequestsTotal.WithLabelValues(h.service, hedgeOutcomeDenied).Inc()
+				continue
+			}
+			hedgeReq, hedgeRelease := ur.retarget(req, other)
+			release[1] = hedgeRelease
+			attempt(other.transport, hedgeReq, true)
+			pending++
+			hedged = true
+
+		case res := <-results:
+			pending--
+			winner, loser := release[0], release[1]
+			if res.hedge {
+				winner, loser = loser, winner
+			}
+			if res.err != nil {
+				winner()
+				// The service settles the first attempt when it is the last one.
+				if res.hedge || pending > 0 {
+					settle(res.hedge, errors.Is(ur.inbound.Context().Err(), context.Canceled), true, 0)
+				}
+				if pending > 0 {
+					continue // The other attempt may still succeed.
+				}
+				if res.hedge {
+					ur.hedgeAnswered = other
+				}
+				return nil, res.err
+			}
+			if hedged {
+				outcome := hedgeOutcomeLost
+				if res.hedge {
+					outcome = hedgeOutcomeWon
+				}
+				HedgedRequestsTotal.WithLabelValues(h.service, outcome).Inc()
+			}
+			if res.hedge {
+				settle(true, false, res.resp.StatusCode >= 500, res.latency)
+				ur.hedgeAnswered = other
+			}
+			if pending > 0 {
+				// Cancel the slower attempt, and close its response if it comes anyway.
+				// Losing says nothing about its backend.
+				settle(!res.hedge, true, false, 0)
+				loser()
+				go func() {
+					if res := <-results; res.resp != nil {
+						res.resp.Body.Close()
+					}
+				}()
+			}
+			// The attempt lives on until its body is read, and its context with it.
+			res.resp.Body = &releasingBody{ReadCloser: res.resp.Body, release: winner}
+			return res.resp, nil
+		}
+	}
+}
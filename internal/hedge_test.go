@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+func TestHedgeRecordsEachBackend(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	s := newTestService(t, config.ServiceType{
+		// Round-robin starts with the second backend, so the slow one is asked first.
+		Backends:       []string{fast.URL, slow.URL},
+		Hedging:        config.HedgingConfig{Enabled: true, Delay: "20ms"},
+		CircuitBreaker: config.BreakerConfig{Enabled: true, SlowCallDuration: "10ms"},
+	})
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	// The fast backend answered and counts a call; the slow one lost and counts none,
+	// as it was canceled rather than answered fast.
+	if total, _, _ := s.Backends[0].breaker.totals(time.Now()); total != 1 {
+		t.Errorf("calls recorded for the hedge that won = %d, want 1", total)
+	}
+	if total, _, _ := s.Backends[1].breaker.totals(time.Now()); total != 0 {
+		t.Errorf("calls recorded for the backend that lost = %d, want 0", total)
+	}
+}
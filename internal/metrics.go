@@ -15,6 +15,24 @@ var (
 		[]string{"service", "path", "method", "code"},
 	)
 
+	// RateLimitedRequestsTotal counts the requests rejected by a rate limit, by rule.
+	RateLimitedRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_rate_limited_total",
+			Help: "Total number of HTTP requests rejected by a rate limit",
+		},
+		[]string{"service", "rule"},
+	)
+
+	// RateLimitStoreErrorsTotal counts the rate limit checks that failed, and let the request through.
+	RateLimitStoreErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limit_store_errors_total",
+			Help: "Total number of rate limit checks that failed because of the store",
+		},
+		[]string{"service"},
+	)
+
 	// HttpRequestDurationSeconds measures the latency of HTTP requests.
 	HttpRequestDurationSeconds = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -25,6 +43,17 @@ var (
 		[]string{"service", "path", "method", "code"},
 	)
 
+	// HttpStreamDurationSeconds measures the lifetime of streaming responses (e.g. Server-Sent Events),
+	// which are kept out of HttpRequestDurationSeconds.
+	HttpStreamDurationSeconds = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_stream_duration_seconds",
+			Help:    "Duration of streaming HTTP responses in seconds",
+			Buckets: []float64{1, 5, 15, 60, 300, 900, 3600, 14400},
+		},
+		[]string{"service", "path", "method", "code"},
+	)
+
 	// ActiveConnections measures the number of currently active connections to each backend.
 	ActiveConnections = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -33,6 +62,268 @@ var (
 		},
 		[]string{"service", "backend_url"},
 	)
+
+	// BackendDialsTotal counts the new connections opened to each backend.
+	BackendDialsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "backend_dials_total",
+			Help: "Total number of new connections dialed to backend services",
+		},
+		[]string{"service", "backend_url"},
+	)
+
+	// BackendConnectionsTotal counts the connections requests got from the pool, by whether they were reused.
+	BackendConnectionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "backend_connections_total",
+			Help: "Total number of connections used for requests to backend services, by reuse",
+		},
+		[]string{"service", "backend_url", "reused"},
+	)
+
+	// BackendConnectionReuseRatio measures the share of requests to each backend that reused a pooled connection.
+	BackendConnectionReuseRatio = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "backend_connection_reuse_ratio",
+			Help: "Ratio of requests to backend services that reused a pooled connection",
+		},
+		[]string{"service", "backend_url"},
+	)
+
+	// CircuitBreakerState reports the circuit breaker state of each backend: 0 closed, 1 half-open, 2 open.
+	CircuitBreakerState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "circuit_breaker_state",
+			Help: "Circuit breaker state of backend services (0 closed, 1 half-open, 2 open)",
+		},
+		[]string{"service", "backend_url"},
+	)
+
+	// CircuitBreakerTransitionsTotal counts the circuit breaker state changes of each backend.
+	CircuitBreakerTransitionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "circuit_breaker_transitions_total",
+			Help: "Total number of circuit breaker state changes of backend services",
+		},
+		[]string{"service", "backend_url", "from", "to"},
+	)
+
+	// QueueDepth reports the number of requests waiting for a backend slot in each service.
+	QueueDepth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "queue_depth",
+			Help: "Number of requests waiting for a backend connection slot",
+		},
+		[]string{"service"},
+	)
+
+	// QueueWaitSeconds measures how long queued requests waited for a backend slot.
+	QueueWaitSeconds = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "queue_wait_seconds",
+			Help:    "Time requests waited in the queue for a backend connection slot",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"service"},
+	)
+
+	// QueueRejectedTotal counts the requests turned away because every backend was at capacity.
+	QueueRejectedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "queue_rejected_total",
+			Help: "Total number of requests rejected because backends were at capacity",
+		},
+		[]string{"service", "reason"},
+	)
+
+	// ConcurrencyLimit reports the current adaptive concurrency limit of each service.
+	ConcurrencyLimit = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "concurrency_limit",
+			Help: "Current adaptive concurrency limit of services",
+		},
+		[]string{"service"},
+	)
+
+	// ConcurrencyInFlight reports the requests in flight counted against the concurrency limit.
+	ConcurrencyInFlight = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "concurrency_in_flight",
+			Help: "Number of requests in flight counted against the adaptive concurrency limit",
+		},
+		[]string{"service"},
+	)
+
+	// ShedRequestsTotal counts the requests shed by the adaptive concurrency limiter, by priority class.
+	ShedRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "shed_requests_total",
+			Help: "Total number of requests shed by the adaptive concurrency limiter",
+		},
+		[]string{"service", "priority"},
+	)
+
+	// HedgedRequestsTotal counts hedged requests by outcome: "won" or "lost" by the hedge, or "denied" by the budget.
+	HedgedRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hedged_requests_total",
+			Help: "Total number of hedged requests, by outcome",
+		},
+		[]string{"service", "outcome"},
+	)
+
+	// HealthCheckDurationSeconds tracks how long health checks of each backend take.
+	HealthCheckDurationSeconds = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "health_check_duration_seconds",
+			Help:    "Duration of health checks, by backend",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"service", "backend"},
+	)
+
+	// HealthChecksTotal counts health checks of each backend by result: "healthy" or "unhealthy".
+	HealthChecksTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "health_checks_total",
+			Help: "Total number of health checks, by backend and result",
+		},
+		[]string{"service", "backend", "result"},
+	)
+
+	// BackendAdminState tracks the administrative state of backends: 0 active, 1 draining, 2 disabled.
+	BackendAdminState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "backend_admin_state",
+			Help: "Administrative state of the backend: 0 active, 1 draining, 2 disabled",
+		},
+		[]string{"service", "backend"},
+	)
+
+	// ServicePanicMode is 1 while a service ignores health checks, as too few of its backends pass them.
+	ServicePanicMode = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_panic_mode",
+			Help: "Whether the service is in panic mode (1) or not (0)",
+		},
+		[]string{"service"},
+	)
+
+	// HealthChecksInFlight tracks the health checks running across all services.
+	HealthChecksInFlight = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "health_checks_in_flight",
+			Help: "Number of health checks in flight",
+		},
+	)
+
+	// FaultsInjectedTotal counts injected faults by fault and type: "delay", "abort" or "reset".
+	FaultsInjectedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faults_injected_total",
+			Help: "Total number of faults injected into requests, by fault and type",
+		},
+		[]string{"service", "fault", "type"},
+	)
+
+	// RetriesTotal counts retries of failed requests by outcome: "allowed", or "denied" by the budget.
+	RetriesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "retries_total",
+			Help: "Total number of retries of failed requests, by outcome",
+		},
+		[]string{"service", "outcome"},
+	)
+
+	// UpstreamTimeoutsTotal counts the requests answered with 504 because a backend timeout fired.
+	UpstreamTimeoutsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_timeouts_total",
+			Help: "Total number of backend timeouts by phase (dial, tls_handshake, response_header, request)",
+		},
+		[]string{"service", "backend_url", "phase"},
+	)
+
+	// UpgradedConnections measures the number of upgraded (e.g. WebSocket) connections tunnelled to each backend.
+	UpgradedConnections = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "upgraded_connections",
+			Help: "Number of active upgraded (e.g. WebSocket) connections to backend services",
+		},
+		[]string{"service", "backend_url"},
+	)
+
+	// UpgradedConnectionsClosedTotal counts closed upgraded connections by the reason they were closed.
+	UpgradedConnectionsClosedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upgraded_connections_closed_total",
+			Help: "Total number of closed upgraded connections by reason (peer, idle, lifetime, shutdown, drain)",
+		},
+		[]string{"service", "backend_url", "reason"},
+	)
+
+	// TCPConnectionsTotal counts the connections relayed by TCP services to each backend.
+	TCPConnectionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcp_connections_total",
+			Help: "Total number of connections relayed by TCP services",
+		},
+		[]string{"service", "backend_url"},
+	)
+
+	// TCPActiveConnections measures the number of connections currently relayed by each TCP service.
+	TCPActiveConnections = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tcp_active_connections",
+			Help: "Number of active connections relayed by TCP services",
+		},
+		[]string{"service"},
+	)
+
+	// TCPConnectionErrorsTotal counts the client connections a TCP service could not relay.
+	TCPConnectionErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcp_connection_errors_total",
+			Help: "Total number of TCP connections that could not be relayed, by reason (no_backend, dial, proxy_header)",
+		},
+		[]string{"service", "reason"},
+	)
+
+	// TCPBytesTotal counts the bytes relayed by TCP services in each direction.
+	TCPBytesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tcp_bytes_total",
+			Help: "Total number of bytes relayed by TCP services, by direction",
+		},
+		[]string{"service", "direction"},
+	)
+
+	// UDPSessions measures the number of client flows currently tracked by each UDP service.
+	UDPSessions = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udp_sessions",
+			Help: "Number of active client sessions of UDP services",
+		},
+		[]string{"service"},
+	)
+
+	// UDPDatagramsTotal counts the datagrams forwarded by UDP services in each direction.
+	UDPDatagramsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "udp_datagrams_total",
+			Help: "Total number of datagrams forwarded by UDP services, by direction",
+		},
+		[]string{"service", "direction"},
+	)
+
+	// UDPDroppedDatagramsTotal counts the datagrams UDP services could not forward.
+	UDPDroppedDatagramsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "udp_dropped_datagrams_total",
+			Help: "Total number of datagrams dropped by UDP services, by reason",
+		},
+		[]string{"service", "reason"},
+	)
 )
 
 // InitMetrics initializes and registers Prometheus metrics. This function is called once at startup.
@@ -1,10 +1,14 @@
 package internal
 
 import (
-	"net/http"
+	"context"
+	"fmt"
 	"net/http/httputil"
 	"net/url"
+	"reflect"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/vinit-chauhan/load-balancer/config"
 	"github.com/vinit-chauhan/load-balancer/logger"
@@ -13,97 +17,437 @@ import (
 type Path string
 
 type LoadBalancer struct {
-	Services map[Path]*Service
-	mux      sync.RWMutex
+	Services   map[Path]*Service
+	TCPProxies map[string]*TCPProxy // Keyed by listen address.
+	UDPProxies map[string]*UDPProxy // Keyed by listen address.
+	mux        sync.RWMutex
+	// Where the rate limits of all services are counted. It outlives config reloads,
+	// unless its own settings change.
+	rateLimitStore     rateLimitStore
+	rateLimitStoreConf config.RateLimitStoreConfig
+	// Backends drained or disabled by operators, which outlive config reloads.
+	adminStates adminStates
+	conf        config.ConfigType // Effective config, as shown by the admin API.
+	source      config.ConfigType // Config as given, which the admin API changes.
+	// Serializes config changes, so changes made through the admin API are not lost.
+	changeMux sync.Mutex
 }
 
-// UpdateServices updates the services in a thread-safe manner.
-func (lb *LoadBalancer) UpdateServices(conf *config.ConfigType) {
-	lb.mux.Lock()
-	defer lb.mux.Unlock()
-
+// UpdateServices updates the services in a thread-safe manner. Services whose config
+// did not change are left alone, and the others keep the backends that did not change,
+// with their state (see newService). Services are built and their new backends checked
+// before they are swapped in, so requests are not held up meanwhile. Config changes
+// must not run concurrently: callers go through ReloadConfig or UpdateConfig.
+func (lb *LoadBalancer) UpdateServices(conf *config.ConfigType) error {
 	logger.Debug("UpdateServices", "updating load balancer services from new config")
+	// Validate all of it and bind the new listeners first, so a config that cannot run
+	// changes nothing.
+	eff := effectiveConfig(conf)
+	addedTCP, addedUDP, err := lb.listenProxies(&eff)
+	if err != nil {
+		return err
+	}
+	healthProbes.resize(conf.HealthChecks.MaxConcurrent)
+
+	// Only config changes write lb's services and proxies, and they do not run
+	// concurrently, so they can be read without lb.mux until the swap.
+	store, storeChanged := lb.rateLimitStore, conf.RateLimitStore != lb.rateLimitStoreConf
+	if storeChanged {
+		store = newRateLimitStore(conf.RateLimitStore)
+	}
+	prev := make(map[string]*Service)
+	for _, svc := range lb.Services {
+		prev[svc.Name] = svc
+	}
 	newServices := make(map[Path]*Service)
+	var built []*Service
+	for _, serviceConf := range eff.Services {
+		old := prev[serviceConf.Name]
+		if old != nil && !storeChanged && reflect.DeepEqual(old.conf, serviceConf) {
+			newServices[Path(serviceConf.UrlPath)] = old
+			continue
+		}
+		svc := newService(serviceConf, store, old)
+		built = append(built, svc)
+		newServices[Path(serviceConf.UrlPath)] = svc
+	}
+	tcpProxies := lb.updateTCPProxies(&eff, addedTCP)
+	udpProxies := lb.updateUDPProxies(&eff, addedUDP)
 
-	for _, serviceConf := range conf.Services {
-		serviceConf.Validate() // Validate service configuration
-		backends := make([]*Backend, len(serviceConf.Backends))
-		for i, backendURL := range serviceConf.Backends {
-			u, err := url.Parse(backendURL)
-			if err != nil {
-				logger.Error("UpdateServices", "error parsing url", "url", backendURL, "error", err)
-				continue
-			}
-			proxy := httputil.NewSingleHostReverseProxy(u)
-			proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, e error) {
-				logger.ErrorContext(r.Context(), "Proxy error", "backend", u.String(), "error", e.Error())
-				w.WriteHeader(http.StatusBadGateway)
-			}
-			backends[i] = &Backend{
-				URL:          u,
-				ReverseProxy: proxy,
-				Alive:        true,
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	// Admin states are applied under the lock, so none set meanwhile is missed.
+	for _, svc := range built {
+		lb.adminStates.apply(svc)
+	}
+	oldServices := lb.Services
+	lb.Services = newServices
+	if storeChanged {
+		lb.rateLimitStore.close()
+		lb.rateLimitStore, lb.rateLimitStoreConf = store, conf.RateLimitStore
+	}
+
+	// Upgraded connections outlive the Backend they were opened on. Let the ones to
+	// backends that are still configured run, and close the others gracefully.
+	live := make(map[*Service]bool)
+	names := make(map[string]bool)
+	kept := make(map[*Backend]bool)
+	for _, svc := range newServices {
+		live[svc] = true
+		names[svc.Name] = true
+		for _, b := range svc.Backends {
+			kept[b] = true
+		}
+	}
+	for _, svc := range oldServices {
+		if live[svc] {
+			continue
+		}
+		svc.Stop()
+		if !names[svc.Name] {
+			ServicePanicMode.DeleteLabelValues(svc.Name)
+		}
+		for _, b := range svc.Backends {
+			if !kept[b] {
+				go b.CloseUpgrades(context.Background(), upgradeClosedDrain)
 			}
 		}
+	}
+	for _, svc := range built {
+		svc.runHealthChecks()
+	}
+	for listen, p := range lb.TCPProxies {
+		if _, ok := tcpProxies[listen]; !ok {
+			p.closeRemoved()
+		}
+	}
+	for listen, p := range lb.UDPProxies {
+		if _, ok := udpProxies[listen]; !ok {
+			p.closeRemoved()
+		}
+	}
+	lb.TCPProxies = tcpProxies
+	lb.UDPProxies = udpProxies
+	lb.pruneAdminStates()
+	lb.conf = eff
+	lb.source = cloneConfig(conf)
+	return nil
+}
 
-		svc := &Service{
-			Name:        serviceConf.Name,
-			Backends:    backends,
-			Algorithm:   serviceConf.Algorithm,
-			HealthCheck: serviceConf.HealthCheck,
+// listenProxies binds the listeners of the TCP and UDP services of conf that lb does
+// not run yet, and returns their proxies, not serving yet. When one cannot be bound,
+// the others are closed and the error returned.
+func (lb *LoadBalancer) listenProxies(conf *config.ConfigType) (map[string]*TCPProxy, map[string]*UDPProxy, error) {
+	tcpProxies := make(map[string]*TCPProxy)
+	udpProxies := make(map[string]*UDPProxy)
+	fail := func(err error) (map[string]*TCPProxy, map[string]*UDPProxy, error) {
+		for _, p := range tcpProxies {
+			p.Close(context.Background()) // Not serving, so nothing to wait for.
+		}
+		for _, p := range udpProxies {
+			p.Close()
+		}
+		return nil, nil, err
+	}
+	for _, serviceConf := range conf.TCPServices {
+		if _, ok := lb.TCPProxies[serviceConf.Listen]; ok {
+			continue
 		}
-		svc.StartHealthCheck()
-		svc.UpdateHashRing()
+		p, err := newTCPProxy(serviceConf, &lb.adminStates)
+		if err != nil {
+			return fail(fmt.Errorf("TCP service %q cannot listen on %s: %w", serviceConf.Name, serviceConf.Listen, err))
+		}
+		tcpProxies[serviceConf.Listen] = p
+	}
+	for _, serviceConf := range conf.UDPServices {
+		if _, ok := lb.UDPProxies[serviceConf.Listen]; ok {
+			continue
+		}
+		p, err := newUDPProxy(serviceConf, &lb.adminStates)
+		if err != nil {
+			return fail(fmt.Errorf("UDP service %q cannot listen on %s: %w", serviceConf.Name, serviceConf.Listen, err))
+		}
+		udpProxies[serviceConf.Listen] = p
+	}
+	return tcpProxies, udpProxies, nil
+}
 
-		newServices[Path(serviceConf.UrlPath)] = svc
+// updateTCPProxies starts the listeners bound for new TCP services, updates the
+// services of the listeners that are kept when their config changed, and returns the
+// proxies of conf. The listeners that are gone are left to the caller to close.
+func (lb *LoadBalancer) updateTCPProxies(conf *config.ConfigType, added map[string]*TCPProxy) map[string]*TCPProxy {
+	proxies := make(map[string]*TCPProxy)
+	for _, serviceConf := range conf.TCPServices {
+		if p, ok := added[serviceConf.Listen]; ok {
+			p.start()
+			proxies[serviceConf.Listen] = p
+			continue
+		}
+		p := lb.TCPProxies[serviceConf.Listen]
+		if !reflect.DeepEqual(p.conf, serviceConf) {
+			p.update(serviceConf, &lb.adminStates)
+		}
+		proxies[serviceConf.Listen] = p
 	}
-	lb.Services = newServices
+	return proxies
 }
 
 func NewLoadBalancer(conf *config.ConfigType) *LoadBalancer {
 	logger.Debug("NewLoadBalancer", "creating new load balancer instance from config")
 
+	lb := &LoadBalancer{}
+	lb.setRateLimitStore(conf.RateLimitStore)
+	conf.HealthChecks.Validate()
+	healthProbes.resize(conf.HealthChecks.MaxConcurrent)
+
 	services := make(map[Path]*Service)
 
 	for _, serviceConf := range conf.Services {
-		serviceConf.Validate() // Validate service configuration
-		backends := make([]*Backend, len(serviceConf.Backends))
-		for i, backendURL := range serviceConf.Backends {
-			u, err := url.Parse(backendURL)
-			if err != nil {
-				logger.Error("NewLoadBalancer", "error parsing url", "url", backendURL, "error", err)
+		svc := newService(serviceConf, lb.rateLimitStore, nil)
+		svc.runHealthChecks()
+		services[Path(serviceConf.UrlPath)] = svc
+	}
+
+	lb.Services = services
+	lb.conf = effectiveConfig(conf)
+	addedTCP, addedUDP, err := lb.listenProxies(&lb.conf)
+	if err != nil {
+		logger.Error("NewLoadBalancer", "error starting TCP and UDP services", "error", err)
+		panic("listen error: " + err.Error())
+	}
+	lb.TCPProxies = lb.updateTCPProxies(&lb.conf, addedTCP)
+	lb.UDPProxies = lb.updateUDPProxies(&lb.conf, addedUDP)
+	lb.source = cloneConfig(conf)
+	return lb
+}
+
+// setRateLimitStore builds the rate limit store shared by the services.
+// The caller must hold lb.mux, or own lb.
+func (lb *LoadBalancer) setRateLimitStore(conf config.RateLimitStoreConfig) {
+	conf.Validate()
+	lb.rateLimitStore = newRateLimitStore(conf)
+	lb.rateLimitStoreConf = conf
+}
+
+// newService builds a Service and its backends from the service configuration, and
+// checks their health once. Its rate limits are counted in store. Its periodic health
+// checks are started with runHealthChecks, after the service it replaces is stopped.
+//
+// prev, when not nil, is the service it replaces. Its backends are kept when their
+// settings did not change, with their connections, circuit, health and upgraded
+// connections, and so are its hedging, retry and concurrency state. Only the new
+// backends get an initial health check.
+func newService(serviceConf config.ServiceType, store rateLimitStore, prev *Service) *Service {
+	serviceConf.Validate() // Validate service configuration
+	kept := make(map[string]*Backend)
+	if prev != nil && reflect.DeepEqual(backendSettings(prev.conf), backendSettings(serviceConf)) {
+		for _, b := range prev.Backends {
+			kept[b.URL.String()] = b
+		}
+	}
+	backends := make([]*Backend, 0, len(serviceConf.Backends))
+	var unchecked []*Backend
+	for _, backendURL := range serviceConf.Backends {
+		u, err := url.Parse(backendURL)
+		if err != nil {
+			logger.Error("newService", "error parsing url", "url", backendURL, "error", err)
+			continue
+		}
+		if b, ok := kept[u.String()]; ok {
+			delete(kept, u.String()) // A backend listed twice gets a Backend of its own.
+			b.weight.Store(int64(serviceConf.Weights[backendURL]))
+			backends = append(backends, b)
+			continue
+		}
+		// Requests are proxied to target, which only differs from u for Unix socket backends.
+		target, socketPath := u, ""
+		if isUnixBackend(backendURL) {
+			if socketPath, target, err = parseUnixBackend(backendURL); err != nil {
+				logger.Error("newService", "error parsing unix socket url", "url", backendURL, "error", err)
 				continue
 			}
-			proxy := httputil.NewSingleHostReverseProxy(u)
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.FlushInterval = flushInterval(serviceConf.FlushInterval)
 
-			// Custom Error Handler for Passive Health Check
-			proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, e error) {
-				logger.ErrorContext(r.Context(), "Proxy error", "backend", u.String(), "error", e.Error())
-				w.WriteHeader(http.StatusBadGateway)
-			}
+		transport := newTransport(serviceConf, u, socketPath)
+		proxy.Transport = transport
+		if serviceConf.Hedging.Enabled || serviceConf.Retries.Attempts > 0 {
+			proxy.Transport = &upstreamTransport{base: transport}
+		}
 
-			backends[i] = &Backend{
-				URL:          u,
-				ReverseProxy: proxy,
-				Alive:        true,
-			}
+		// gRPC health checks need HTTP/2, which backends of other protocols are not sent.
+		checkPool := transport
+		if serviceConf.HealthCheck.Type == "grpc" && serviceConf.Protocol != "grpc" {
+			checkPool = transport.Clone()
+			useGrpcProtocols(checkPool)
 		}
 
-		svc := &Service{
-			Name:        serviceConf.Name,
-			Backends:    backends,
-			Algorithm:   serviceConf.Algorithm,
-			HealthCheck: serviceConf.HealthCheck,
+		// Custom Error Handler for Passive Health Check
+		proxy.ErrorHandler = newErrorHandler(serviceConf, u)
+
+		b := &Backend{
+			URL:          u,
+			socketPath:   socketPath,
+			ServiceName:  serviceConf.Name,
+			ReverseProxy: proxy,
+			transport:    transport,
+			checkPool:    checkPool,
+			Alive:        true,
+			breaker:      newCircuitBreaker(serviceConf, u.String()),
+			maxConns:     int64(serviceConf.MaxConnections),
 		}
-		
-		// Initialize Health Check & Hash Ring
-		svc.StartHealthCheck()
-		svc.UpdateHashRing()
+		b.weight.Store(int64(serviceConf.Weights[backendURL]))
+		backends = append(backends, b)
+		unchecked = append(unchecked, b)
+	}
 
-		services[Path(serviceConf.UrlPath)] = svc
+	svc := &Service{
+		Name:        serviceConf.Name,
+		Backends:    backends,
+		Algorithm:   serviceConf.Algorithm,
+		Protocol:    serviceConf.Protocol,
+		HealthCheck: serviceConf.HealthCheck,
+		stop:        make(chan struct{}),
+		conf:        serviceConf,
+	}
+	svc.healthChecker = newHealthChecker(serviceConf.HealthCheck, serviceConf.Protocol)
+	svc.updateWeighted()
+	svc.requestTimeout = parseTimeout(serviceConf.Timeouts.Request, 0)
+	svc.rateLimiter = newRateLimiter(serviceConf, store)
+	svc.concurrency = newConcurrencyLimiter(serviceConf)
+	svc.hedger = newHedger(serviceConf)
+	svc.retrier = newRetrier(serviceConf)
+	if prev != nil {
+		// Requests in flight give their slot back to the limiter they took it from.
+		if reflect.DeepEqual(prev.conf.AdaptiveConcurrency, serviceConf.AdaptiveConcurrency) {
+			svc.concurrency = prev.concurrency
+		}
+		if reflect.DeepEqual(prev.conf.Hedging, serviceConf.Hedging) {
+			svc.hedger = prev.hedger
+		}
+		if reflect.DeepEqual(prev.conf.Retries, serviceConf.Retries) {
+			svc.retrier = prev.retrier
+		}
+	}
+	svc.faults = newFaultInjector(serviceConf)
+	svc.panicThreshold = serviceConf.PanicThreshold / 100
+	ServicePanicMode.WithLabelValues(svc.Name).Set(0) // The service it replaces may have panicked.
+	if serviceConf.MaxConnections > 0 && serviceConf.MaxPending > 0 {
+		svc.queue = &requestQueue{
+			service:    serviceConf.Name,
+			maxPending: serviceConf.MaxPending,
+			timeout:    parseTimeout(serviceConf.QueueTimeout, defaultQueueTimeout),
+		}
+	}
+	// Unparsable limits are treated as "no limit".
+	svc.upgradeLimits.idleTimeout, _ = time.ParseDuration(serviceConf.WebSocket.IdleTimeout)
+	svc.upgradeLimits.maxLifetime, _ = time.ParseDuration(serviceConf.WebSocket.MaxLifetime)
+
+	// Initialize Health Check & Hash Ring
+	if prev != nil && !reflect.DeepEqual(prev.HealthCheck, svc.HealthCheck) {
+		unchecked = backends // The status of the kept backends was up to other checks.
+	}
+	svc.checkHealth(unchecked)
+	svc.UpdateHashRing()
+
+	return svc
+}
+
+// backendSettings returns the settings of a service its backends are built with.
+// Backends are kept by config changes that leave them alone.
+func backendSettings(serviceConf config.ServiceType) config.ServiceType {
+	return config.ServiceType{
+		Name:           serviceConf.Name,
+		Protocol:       serviceConf.Protocol,
+		FlushInterval:  serviceConf.FlushInterval,
+		Timeouts:       serviceConf.Timeouts,
+		ConnectionPool: serviceConf.ConnectionPool,
+		CircuitBreaker: serviceConf.CircuitBreaker,
+		MaxConnections: serviceConf.MaxConnections,
+		HealthCheck:    config.HealthCheckConfig{Type: serviceConf.HealthCheck.Type},
+		Hedging:        config.HedgingConfig{Enabled: serviceConf.Hedging.Enabled},
+		Retries:        config.RetryConfig{Attempts: min(serviceConf.Retries.Attempts, 1)},
+	}
+}
+
+// CloseUpgradedConns gracefully closes the upgraded (e.g. WebSocket) connections of
+// every backend, and waits until they are gone or ctx expires. It is meant to be
+// called on shutdown, since http.Server.Shutdown does not track hijacked connections.
+func (lb *LoadBalancer) CloseUpgradedConns(ctx context.Context) {
+	lb.mux.RLock()
+	var backends []*Backend
+	for _, svc := range lb.Services {
+		backends = append(backends, svc.Backends...)
+	}
+	lb.mux.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.CloseUpgrades(ctx, upgradeClosedShutdown)
+		}()
 	}
+	wg.Wait()
+}
+
+// updateUDPProxies starts the sockets bound for new UDP services, updates the
+// services of the sockets that are kept when their config changed, and returns the
+// proxies of conf. The sockets that are gone are left to the caller to close.
+func (lb *LoadBalancer) updateUDPProxies(conf *config.ConfigType, added map[string]*UDPProxy) map[string]*UDPProxy {
+	proxies := make(map[string]*UDPProxy)
+	for _, serviceConf := range conf.UDPServices {
+		if p, ok := added[serviceConf.Listen]; ok {
+			p.start()
+			proxies[serviceConf.Listen] = p
+			continue
+		}
+		p := lb.UDPProxies[serviceConf.Listen]
+		if !reflect.DeepEqual(p.conf, serviceConf) {
+			p.update(serviceConf, &lb.adminStates)
+		}
+		proxies[serviceConf.Listen] = p
+	}
+	return proxies
+}
 
-	return &LoadBalancer{Services: services}
+// StopTCPProxies closes the TCP listeners and waits for their connections to end
+// until ctx expires, after which the remaining connections are dropped.
+func (lb *LoadBalancer) StopTCPProxies(ctx context.Context) {
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, p := range lb.TCPProxies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Close(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// StopUDPProxies closes the UDP listeners and drops their sessions.
+func (lb *LoadBalancer) StopUDPProxies() {
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+
+	for _, p := range lb.UDPProxies {
+		p.Close()
+	}
+}
+
+// flushInterval converts the flush_interval setting of a service into the
+// httputil.ReverseProxy convention, where a negative value flushes after every write.
+func flushInterval(setting string) time.Duration {
+	if setting == "immediate" {
+		return -1
+	}
+	d, _ := time.ParseDuration(setting)
+	return d
 }
 
 func (lb *LoadBalancer) GetServices(path string) *Service {
@@ -115,3 +459,22 @@ func (lb *LoadBalancer) GetServices(path string) *Service {
 	}
 	return service
 }
+
+// MatchService returns the service of a request path, like http.ServeMux would route
+// it to the service endpoints: an endpoint ending with "/" matches the paths it
+// prefixes, the longest one winning, other endpoints match their path only.
+func (lb *LoadBalancer) MatchService(path string) *Service {
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+	if svc, ok := lb.Services[Path(path)]; ok {
+		return svc
+	}
+	var match *Service
+	longest := 0
+	for endpoint, svc := range lb.Services {
+		if strings.HasSuffix(string(endpoint), "/") && strings.HasPrefix(path, string(endpoint)) && len(endpoint) > longest {
+			match, longest = svc, len(endpoint)
+		}
+	}
+	return match
+}
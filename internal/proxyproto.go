@@ -0,0 +1,274 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+	"github.com/vinit-chauhan/load-balancer/logger"
+)
+
+// proxyHeaderTimeout bounds how long a trusted client may take to send its PROXY header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener accepts PROXY protocol headers from trusted sources, so the
+// accepted connections report the real client address instead of the proxy's.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// NewProxyProtoListener wraps ln so connections from the trusted CIDRs of conf must
+// start with a PROXY protocol v1 or v2 header. It returns ln unchanged when PROXY
+// protocol is disabled, and an error when it is enabled without trusted CIDRs, as
+// any client could then claim any address.
+func NewProxyProtoListener(ln net.Listener, conf config.ProxyProtocolConfig) (net.Listener, error) {
+	if !conf.Enabled {
+		return ln, nil
+	}
+	if len(conf.TrustedCIDRs) == 0 {
+		return nil, errors.New("PROXY protocol needs trusted_cidrs")
+	}
+	trusted := make([]*net.IPNet, 0, len(conf.TrustedCIDRs))
+	for _, cidr := range conf.TrustedCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted CIDR %q: %w", cidr, err)
+		}
+		trusted = append(trusted, ipNet)
+	}
+	return &proxyProtoListener{Listener: ln, trusted: trusted}, nil
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtoConn{Conn: conn}, nil
+}
+
+func (l *proxyProtoListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range l.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtoConn reads the PROXY header lazily, on the first call that needs it,
+// so a slow client does not block the accept loop.
+type proxyProtoConn struct {
+	net.Conn
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr // Client address from the header, nil for LOCAL/UNKNOWN headers.
+	local  net.Addr
+	err    error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.reader = bufio.NewReader(c.Conn)
+		c.remote, c.local, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			logger.Error("ProxyProtocol", "Invalid PROXY protocol header", "peer", c.Conn.RemoteAddr().String(), "error", c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	c.init()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite half-closes the underlying connection, when it supports it.
+func (c *proxyProtoConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readProxyHeader parses a PROXY protocol v1 or v2 header and returns the source and
+// destination addresses it carries. Both are nil for LOCAL (v2) and UNKNOWN (v1)
+// headers, which proxies send for their own connections, e.g. health checks.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	prefix, err := r.Peek(5)
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(prefix) == "PROXY" {
+		return readProxyHeaderV1(r)
+	}
+	prefix, err = r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	return nil, nil, errors.New("missing PROXY protocol header")
+}
+
+// readProxyHeaderV1 parses "PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < 107 { // The longest valid v1 header, CRLF included.
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("PROXY v1 header too long")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY address %s:%s", ip, port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// readProxyHeaderV2 parses the binary v2 header. TLVs are skipped.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, errors.New("unsupported PROXY v2 version")
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, errors.New("unsupported PROXY v2 command")
+	}
+
+	switch header[13] {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(payload) < 12 {
+			return nil, nil, errors.New("short PROXY v2 IPv4 addresses")
+		}
+		src := &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		dst := &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+		return src, dst, nil
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(payload) < 36 {
+			return nil, nil, errors.New("short PROXY v2 IPv6 addresses")
+		}
+		src := &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		dst := &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+		return src, dst, nil
+	default: // UNSPEC or unix sockets: keep the connection addresses.
+		return nil, nil, nil
+	}
+}
+
+// proxyHeader builds the PROXY protocol header ("v1" or "v2") announcing a
+// connection from src to dst.
+func proxyHeader(version string, src, dst net.Addr) []byte {
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+	ipv4 := srcOK && dstOK && srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil
+
+	if version == "v1" {
+		switch {
+		case !srcOK || !dstOK:
+			return []byte("PROXY UNKNOWN\r\n")
+		case ipv4:
+			return fmt.Appendf(nil, "PROXY TCP4 %s %s %d %d\r\n", srcAddr.IP.To4(), dstAddr.IP.To4(), srcAddr.Port, dstAddr.Port)
+		default:
+			return fmt.Appendf(nil, "PROXY TCP6 %s %s %d %d\r\n", srcAddr.IP.To16(), dstAddr.IP.To16(), srcAddr.Port, dstAddr.Port)
+		}
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+	switch {
+	case !srcOK || !dstOK:
+		return append(header, 0x20, 0x00, 0, 0) // LOCAL
+	case ipv4:
+		header = append(header, 0x21, 0x11, 0, 12)
+		header = append(header, srcAddr.IP.To4()...)
+		header = append(header, dstAddr.IP.To4()...)
+	default:
+		header = append(header, 0x21, 0x21, 0, 36)
+		header = append(header, srcAddr.IP.To16()...)
+		header = append(header, dstAddr.IP.To16()...)
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(srcAddr.Port))
+	return binary.BigEndian.AppendUint16(header, uint16(dstAddr.Port))
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(b ...byte) string { return string(proxyV2Signature) + string(b) }
+	tests := []struct {
+		name     string
+		input    string
+		src, dst string // Empty when the header carries no addresses.
+		wantErr  bool
+	}{
+		{
+			name:  "v1 TCP4",
+			input: "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\nGET /",
+			src:   "192.0.2.1:56324",
+			dst:   "198.51.100.2:443",
+		},
+		{
+			name:  "v1 TCP6",
+			input: "PROXY TCP6 2001:db8::1 2001:db8::2 1234 80\r\n",
+			src:   "[2001:db8::1]:1234",
+			dst:   "[2001:db8::2]:80",
+		},
+		{name: "v1 UNKNOWN", input: "PROXY UNKNOWN\r\n"},
+		{name: "v1 UNKNOWN with addresses", input: "PROXY UNKNOWN ff ff 1 2\r\n"},
+		{name: "v1 missing fields", input: "PROXY TCP4 192.0.2.1 198.51.100.2 1\r\n", wantErr: true},
+		{name: "v1 bad protocol", input: "PROXY UDP4 192.0.2.1 198.51.100.2 1 2\r\n", wantErr: true},
+		{name: "v1 bad address", input: "PROXY TCP4 192.0.2 198.51.100.2 1 2\r\n", wantErr: true},
+		{name: "v1 bad port", input: "PROXY TCP4 192.0.2.1 198.51.100.2 1 65536\r\n", wantErr: true},
+		{name: "v1 no CRLF", input: "PROXY TCP4 192.0.2.1 198.51.100.2 1 2\n", wantErr: true},
+		{name: "v1 too long", input: "PROXY " + strings.Repeat("x", 200) + "\r\n", wantErr: true},
+		{
+			name:  "v2 TCP4",
+			input: v2(0x21, 0x11, 0, 12, 192, 0, 2, 1, 198, 51, 100, 2, 0xdc, 0x04, 0x01, 0xbb),
+			src:   "192.0.2.1:56324",
+			dst:   "198.51.100.2:443",
+		},
+		{
+			name: "v2 TCP6",
+			input: v2(append([]byte{0x21, 0x21, 0, 36},
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+				0x04, 0xd2, 0x00, 0x50)...),
+			src: "[2001:db8::1]:1234",
+			dst: "[2001:db8::2]:80",
+		},
+		{
+			name:  "v2 TLVs skipped",
+			input: v2(0x21, 0x11, 0, 15, 192, 0, 2, 1, 198, 51, 100, 2, 0xdc, 0x04, 0x01, 0xbb, 0x04, 0x00, 0x00),
+			src:   "192.0.2.1:56324",
+			dst:   "198.51.100.2:443",
+		},
+		{name: "v2 LOCAL", input: v2(0x20, 0x00, 0, 0)},
+		{name: "v2 unix", input: v2(0x21, 0x31, 0, 0)},
+		{name: "v2 bad version", input: v2(0x11, 0x11, 0, 0), wantErr: true},
+		{name: "v2 bad command", input: v2(0x22, 0x11, 0, 0), wantErr: true},
+		{name: "v2 short IPv4", input: v2(0x21, 0x11, 0, 4, 1, 2, 3, 4), wantErr: true},
+		{name: "v2 truncated payload", input: v2(0x21, 0x11, 0, 12, 1, 2), wantErr: true},
+		{name: "no header", input: "GET / HTTP/1.1\r\n\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst, err := readProxyHeader(bufio.NewReader(strings.NewReader(tt.input)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := addrString(src); got != tt.src {
+				t.Errorf("src = %q, want %q", got, tt.src)
+			}
+			if got := addrString(dst); got != tt.dst {
+				t.Errorf("dst = %q, want %q", got, tt.dst)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderLeavesPayload(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.2 1 2\r\nhello"))
+	if _, _, err := readProxyHeader(r); err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "hello" {
+		t.Errorf("payload = %q, want %q", rest, "hello")
+	}
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+	}{
+		{"IPv4", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}, &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 443}},
+		{"IPv6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}},
+		{"mixed", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2}},
+		{"not TCP", &net.UnixAddr{Name: "/run/a.sock", Net: "unix"}, &net.UnixAddr{Name: "/run/b.sock", Net: "unix"}},
+	}
+	for _, version := range []string{"v1", "v2"} {
+		for _, tt := range tests {
+			t.Run(version+" "+tt.name, func(t *testing.T) {
+				header := proxyHeader(version, tt.src, tt.dst)
+				src, dst, err := readProxyHeader(bufio.NewReader(strings.NewReader(string(header))))
+				if err != nil {
+					t.Fatalf("readProxyHeader(%q): %v", header, err)
+				}
+				wantSrc, wantDst := "", ""
+				if _, ok := tt.src.(*net.TCPAddr); ok {
+					wantSrc, wantDst = tt.src.String(), tt.dst.String()
+				}
+				if got := addrString(src); got != wantSrc {
+					t.Errorf("src = %q, want %q", got, wantSrc)
+				}
+				if got := addrString(dst); got != wantDst {
+					t.Errorf("dst = %q, want %q", got, wantDst)
+				}
+			})
+		}
+	}
+}
+
+func TestProxyProtoListenerTrust(t *testing.T) {
+	ln, err := NewProxyProtoListener(nil, config.ProxyProtocolConfig{Enabled: true, TrustedCIDRs: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := ln.(*proxyProtoListener)
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, false},
+		{&net.UnixAddr{Name: "@", Net: "unix"}, false},
+	}
+	for _, tt := range tests {
+		if got := pl.isTrusted(tt.addr); got != tt.want {
+			t.Errorf("isTrusted(%v) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	if _, err := NewProxyProtoListener(nil, config.ProxyProtocolConfig{Enabled: true, TrustedCIDRs: []string{"10.0.0.0/33"}}); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+	// Trusting everyone would let any client set its address.
+	if _, err := NewProxyProtoListener(nil, config.ProxyProtocolConfig{Enabled: true}); err == nil {
+		t.Error("PROXY protocol enabled without trusted CIDRs")
+	}
+	if ln, _ := NewProxyProtoListener(pl, config.ProxyProtocolConfig{}); ln != pl {
+		t.Error("disabled PROXY protocol wrapped the listener")
+	}
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"container/list"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultQueueTimeout bounds how long a request waits for a backend slot by default.
+const defaultQueueTimeout = time.Second
+
+// Reasons a request is turned away by the queue, used as the "reason" metric label.
+const (
+	queueRejectedFull    = "full"
+	queueRejectedTimeout = "timeout"
+)
+
+// requestQueue holds the requests waiting for a backend connection slot, in arrival
+// order. Only the request at the head tries to take a slot; it is woken up whenever
+// a slot is released or the request ahead of it leaves.
+type requestQueue struct {
+	service    string
+	maxPending int
+	timeout    time.Duration
+	mux        sync.Mutex
+	waiters    list.List // Of chan struct{}, buffered so a wake-up is never lost.
+}
+
+// enqueue adds a waiter at the tail of the queue. It returns false when the queue is full.
+func (q *requestQueue) enqueue() (*list.Element, bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.waiters.Len() >= q.maxPending {
+		return nil, false
+	}
+	e := q.waiters.PushBack(make(chan struct{}, 1))
+	QueueDepth.WithLabelValues(q.service).Set(float64(q.waiters.Len()))
+	return e, true
+}
+
+// remove takes a waiter out of the queue, and wakes up the next one if it was the head.
+func (q *requestQueue) remove(e *list.Element) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	wasHead := q.waiters.Front() == e
+	q.waiters.Remove(e)
+	QueueDepth.WithLabelValues(q.service).Set(float64(q.waiters.Len()))
+	if wasHead {
+		q.wakeLocked()
+	}
+}
+
+// isHead reports whether the waiter is first in line.
+func (q *requestQueue) isHead(e *list.Element) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.waiters.Front() == e
+}
+
+// empty reports whether no request is waiting, so new requests may take a slot
+// without jumping the queue.
+func (q *requestQueue) empty() bool {
+	if q == nil {
+		return true
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.waiters.Len() == 0
+}
+
+// wake tells the head of the queue that a slot may be available.
+func (q *requestQueue) wake() {
+	if q == nil {
+		return
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	q.wakeLocked()
+}
+
+func (q *requestQueue) wakeLocked() {
+	if head := q.waiters.Front(); head != nil {
+		select {
+		case head.Value.(chan struct{}) <- struct{}{}:
+		default: // Already woken up.
+		}
+	}
+}
+
+// retryAfter is the Retry-After value, in seconds, sent with requests turned away.
+func (q *requestQueue) retryAfter() string {
+	if q == nil || q.timeout < time.Second {
+		return "1"
+	}
+	return strconv.Itoa(int((q.timeout + time.Second - 1) / time.Second))
+}
+
+// hasCapacity reports whether the backend may take one more request.
+func (b *Backend) hasCapacity() bool {
+	return b.maxConns == 0 || b.GetActiveConns() < b.maxConns
+}
+
+// tryIncConn takes a connection slot on the backend, unless it is at max_connections.
+func (b *Backend) tryIncConn() bool {
+	for {
+		n := atomic.LoadInt64(&b.ActiveConns)
+		if b.maxConns > 0 && n >= b.maxConns {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.ActiveConns, n, n+1) {
+			return true
+		}
+	}
+}
+
+// atCapacity reports whether requests cannot be served only because every backend
+// that could serve them is at max_connections.
+func (s *Service) atCapacity() bool {
+	full := false
+	for _, b := range s.Backends {
+		if b.adminState() != adminActive || !s.healthy(b) || !b.breaker.ready() {
+			continue
+		}
+		if b.hasCapacity() {
+			return false
+		}
+		full = true
+	}
+	return full
+}
+
+// tryAcquire picks a backend for r and takes one of its connection slots. It returns
+// nil when no backend can take the request right now.
+func (s *Service) tryAcquire(r *http.Request) *Backend {
+	// Another request may take the slot between the pick and tryIncConn, so try again
+	// with the next pick, at most once per backend.
+	for range s.Backends {
+		b := s.GetNextBackend(r)
+		if b == nil {
+			return nil
+		}
+		if !b.tryIncConn() {
+			continue
+		}
+		if !b.breaker.allow() {
+			// Another request took the last half-open probe slot.
+			b.DecConn()
+			s.queue.wake()
+			return nil
+		}
+		ActiveConnections.WithLabelValues(b.ServiceName, b.URL.String()).Inc()
+		return b
+	}
+	return nil
+}
+
+// acquireOther picks a backend for an extra attempt of r, a hedge or a retry, other than
+// the excluded ones, and takes one of its connection slots. Extra attempts never wait:
+// while requests are queued they go first, and nil is returned. Backends whose circuit
+// is not closed are skipped, so extra attempts never take their probe slots.
+func (s *Service) acquireOther(r *http.Request, exclude []*Backend) *Backend {
+	if !s.queue.empty() {
+		return nil
+	}
+	exclude = slices.Clip(exclude)
+	for range s.Backends {
+		b := s.nextBackend(r.RemoteAddr, exclude)
+		if b == nil {
+			return nil
+		}
+		if !b.breaker.closed() || !b.tryIncConn() {
+			exclude = append(exclude, b)
+			continue
+		}
+		ActiveConnections.WithLabelValues(b.ServiceName, b.URL.String()).Inc()
+		return b
+	}
+	return nil
+}
+
+// acquireBackend picks the backend serving r and takes one of its connection slots.
+// When every backend is at max_connections, the request waits in the queue of the
+// service until a slot is released, the queue timeout expires or the request is
+// canceled. rejected is true when the request was turned away because of capacity.
+func (s *Service) acquireBackend(r *http.Request) (b *Backend, rejected bool) {
+	if s.queue.empty() {
+		if b = s.tryAcquire(r); b != nil || !s.atCapacity() {
+			return b, false
+		}
+	}
+	if s.queue == nil {
+		QueueRejectedTotal.WithLabelValues(s.Name, queueRejectedFull).Inc()
+		return nil, true
+	}
+
+	e, ok := s.queue.enqueue()
+	if !ok {
+		QueueRejectedTotal.WithLabelValues(s.Name, queueRejectedFull).Inc()
+		return nil, true
+	}
+	defer s.queue.remove(e)
+
+	start := time.Now()
+	timer := time.NewTimer(s.queue.timeout)
+	defer timer.Stop()
+	for {
+		if s.queue.isHead(e) {
+			if b = s.tryAcquire(r); b != nil {
+				QueueWaitSeconds.WithLabelValues(s.Name).Observe(time.Since(start).Seconds())
+				return b, false
+			}
+			if !s.atCapacity() {
+				return nil, false // No backend is left to wait for.
+			}
+		}
+		select {
+		case <-e.Value.(chan struct{}):
+		case <-timer.C:
+			QueueWaitSeconds.WithLabelValues(s.Name).Observe(time.Since(start).Seconds())
+			QueueRejectedTotal.WithLabelValues(s.Name, queueRejectedTimeout).Inc()
+			return nil, true
+		case <-r.Context().Done():
+			return nil, false
+		}
+	}
+}
+
+// releaseBackend gives back a connection slot taken by acquireBackend.
+func (s *Service) releaseBackend(b *Backend) {
+	b.DecConn()
+	ActiveConnections.WithLabelValues(b.ServiceName, b.URL.String()).Dec()
+	s.queue.wake()
+}
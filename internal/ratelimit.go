@@ -0,0 +1,308 @@
+package internal
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+	"github.com/vinit-chauhan/load-balancer/logger"
+)
+
+// defaultRateLimitWindow is the window of rate limits that do not set one.
+const defaultRateLimitWindow = time.Second
+
+// rateLimitSweepInterval is how often keys that are back to a full quota are forgotten.
+const rateLimitSweepInterval = time.Minute
+
+// rateLimitRule is a parsed config.RateLimitConfig.
+type rateLimitRule struct {
+	name      string
+	key       string // "ip", "route" or "header".
+	header    string // Header holding the key, for "header" keys.
+	algorithm string // "token-bucket" or "sliding-window".
+	limit     int
+	burst     int // Token bucket size.
+	window    time.Duration
+}
+
+// rateLimitResult is the outcome of counting a request against a rule.
+type rateLimitResult struct {
+	allowed   bool
+	limit     int
+	remaining int
+	reset     time.Duration // Until the quota is fully available again.
+	retry     time.Duration // Until the next request would be allowed, for denied requests.
+}
+
+// rateLimitStore keeps the state of the rate limited keys. A store shared by the
+// replicas of the load balancer, such as Redis, enforces the limits across all of them.
+type rateLimitStore interface {
+	// take counts a request for key against rule.
+	take(ctx context.Context, key string, rule rateLimitRule, now time.Time) (rateLimitResult, error)
+	// close releases the resources of the store once it is replaced.
+	close()
+}
+
+// newRateLimitStore builds the store configured for the rate limits of every service.
+func newRateLimitStore(conf config.RateLimitStoreConfig) rateLimitStore {
+	if conf.Type == "redis" {
+		return newRedisRateLimitStore(conf.Redis)
+	}
+	return newMemoryRateLimitStore()
+}
+
+// rateLimiter enforces the rate limits of a service. A request must be allowed by
+// every rule; the RateLimit-* headers describe the rule closest to its limit.
+// A nil *rateLimiter allows every request.
+type rateLimiter struct {
+	service string
+	rules   []rateLimitRule
+	store   rateLimitStore
+}
+
+// newRateLimiter builds the rate limiter of a service, or returns nil when it has no rate limits.
+func newRateLimiter(serviceConf config.ServiceType, store rateLimitStore) *rateLimiter {
+	if len(serviceConf.RateLimits) == 0 {
+		return nil
+	}
+	l := &rateLimiter{service: serviceConf.Name, store: store}
+	for i, conf := range serviceConf.RateLimits {
+		rule := rateLimitRule{
+			name:      conf.Name,
+			key:       conf.Key,
+			algorithm: conf.Algorithm,
+			limit:     conf.Limit,
+			burst:     conf.Burst,
+			window:    parseTimeout(conf.Window, defaultRateLimitWindow),
+		}
+		if rule.name == "" {
+			rule.name = "rule-" + strconv.Itoa(i)
+		}
+		if name, ok := strings.CutPrefix(conf.Key, "header:"); ok {
+			rule.key, rule.header = "header", name
+		}
+		if rule.key == "" {
+			rule.key = "ip"
+		}
+		if rule.algorithm == "" {
+			rule.algorithm = "token-bucket"
+		}
+		if rule.burst <= 0 {
+			rule.burst = rule.limit
+		}
+		l.rules = append(l.rules, rule)
+	}
+	return l
+}
+
+// allow counts the request against every rule and sets the RateLimit-* headers.
+// When a rule denies it, allow answers with 429 and returns false.
+func (l *rateLimiter) allow(w http.ResponseWriter, r *http.Request, grpc bool) bool {
+	if l == nil {
+		return true
+	}
+	var tightest *rateLimitResult
+	denied := ""
+	now := time.Now()
+	for _, rule := range l.rules {
+		res, err := l.store.take(r.Context(), l.service+"|"+rule.name+"|"+rule.clientKey(r), rule, now)
+		if err != nil {
+			// Fail open: an unreachable store must not take the service down with it.
+			logger.Error("RateLimit", "Rate limit store error", "service", l.service, "rule", rule.name, "error", err)
+			RateLimitStoreErrorsTotal.WithLabelValues(l.service).Inc()
+			res = rateLimitResult{allowed: true, limit: rule.limit, remaining: rule.limit}
+		}
+		if !res.allowed && denied == "" {
+			denied = rule.name
+		}
+		if tightest == nil || (!res.allowed && tightest.allowed) ||
+			(res.allowed == tightest.allowed && res.remaining < tightest.remaining) {
+			tightest = &res
+		}
+	}
+
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(tightest.limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(tightest.remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(tightest.reset)))
+	if denied == "" {
+		return true
+	}
+
+	RateLimitedRequestsTotal.WithLabelValues(l.service, denied).Inc()
+	h.Set("Retry-After", strconv.Itoa(max(ceilSeconds(tightest.retry), 1)))
+	if grpc {
+		writeGrpcError(w, grpcResourceExhausted, "rate limit exceeded")
+	} else {
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+	}
+	return false
+}
+
+// clientKey returns what the rule counts requests by. Requests without the header of
+// a "header" rule are counted by client IP, so leaving out an API key is no way around it.
+func (rule rateLimitRule) clientKey(r *http.Request) string {
+	switch rule.key {
+	case "route":
+		return "route:" + r.URL.Path
+	case "header":
+		if v := r.Header.Get(rule.header); v != "" {
+			return "header:" + v
+		}
+	}
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	return "ip:" + ip
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// memoryRateLimitStore keeps the rate limit state of the keys in process memory.
+type memoryRateLimitStore struct {
+	mux       sync.Mutex
+	buckets   map[string]*tokenBucket
+	windows   map[string]*slidingWindow
+	lastSweep time.Time
+}
+
+// tokenBucket holds up to burst tokens, refilled at limit tokens per window. Each
+// request takes one.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // When the bucket is full again, if no request comes.
+}
+
+// slidingWindow approximates the requests of the last window from the counts of the
+// current and previous fixed windows, weighting the previous one by its overlap.
+type slidingWindow struct {
+	start    time.Time // Start of the current fixed window.
+	current  int
+	previous int
+	expires  time.Time // When both counts are out of the window.
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		buckets:   make(map[string]*tokenBucket),
+		windows:   make(map[string]*slidingWindow),
+		lastSweep: time.Now(),
+	}
+}
+
+func (m *memoryRateLimitStore) take(_ context.Context, key string, rule rateLimitRule, now time.Time) (rateLimitResult, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if now.Sub(m.lastSweep) >= rateLimitSweepInterval {
+		m.sweep(now)
+	}
+	if rule.algorithm == "sliding-window" {
+		w, ok := m.windows[key]
+		if !ok {
+			w = &slidingWindow{start: now.Truncate(rule.window)}
+			m.windows[key] = w
+		}
+		return w.take(rule, now), nil
+	}
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(rule.burst), last: now}
+		m.buckets[key] = b
+	}
+	return b.take(rule, now), nil
+}
+
+func (m *memoryRateLimitStore) close() {}
+
+// sweep forgets the keys idle long enough to be back to a full quota, which is the
+// state a new key starts in. The caller must hold m.mux.
+func (m *memoryRateLimitStore) sweep(now time.Time) {
+	m.lastSweep = now
+	for key, b := range m.buckets {
+		if !now.Before(b.full) {
+			delete(m.buckets, key)
+		}
+	}
+	for key, w := range m.windows {
+		if !now.Before(w.expires) {
+			delete(m.windows, key)
+		}
+	}
+}
+
+func (b *tokenBucket) take(rule rateLimitRule, now time.Time) rateLimitResult {
+	rate := float64(rule.limit) / rule.window.Seconds() // Tokens per second.
+	b.tokens = math.Min(float64(rule.burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	res := tokenBucketResult(rule, b.tokens, allowed)
+	b.full = now.Add(res.reset)
+	return res
+}
+
+// tokenBucketResult describes a token bucket left with tokens after a request.
+func tokenBucketResult(rule rateLimitRule, tokens float64, allowed bool) rateLimitResult {
+	rate := float64(rule.limit) / rule.window.Seconds()
+	res := rateLimitResult{allowed: allowed, limit: rule.burst, remaining: int(tokens)}
+	if !allowed {
+		res.retry = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	res.reset = time.Duration((float64(rule.burst) - tokens) / rate * float64(time.Second))
+	return res
+}
+
+func (w *slidingWindow) take(rule rateLimitRule, now time.Time) rateLimitResult {
+	start := now.Truncate(rule.window)
+	switch {
+	case start.Sub(w.start) >= 2*rule.window:
+		w.previous, w.current = 0, 0
+	case start.After(w.start):
+		w.previous, w.current = w.current, 0
+	}
+	w.start = start
+	w.expires = start.Add(2 * rule.window)
+
+	elapsed := now.Sub(start)
+	count := float64(w.previous)*slidingWindowWeight(rule, elapsed) + float64(w.current)
+	allowed := count < float64(rule.limit)
+	if allowed {
+		w.current++
+		count++
+	}
+	return slidingWindowResult(rule, count, allowed, elapsed)
+}
+
+// slidingWindowWeight is the share of the previous fixed window still in the sliding
+// window, elapsed into the current one.
+func slidingWindowWeight(rule rateLimitRule, elapsed time.Duration) float64 {
+	return 1 - elapsed.Seconds()/rule.window.Seconds()
+}
+
+// slidingWindowResult describes a sliding window counting count requests, elapsed
+// into the current fixed window.
+func slidingWindowResult(rule rateLimitRule, count float64, allowed bool, elapsed time.Duration) rateLimitResult {
+	res := rateLimitResult{
+		allowed:   allowed,
+		limit:     rule.limit,
+		remaining: max(rule.limit-int(math.Ceil(count)), 0),
+		reset:     rule.window - elapsed,
+	}
+	if !allowed {
+		res.retry = rule.window - elapsed
+	}
+	return res
+}
@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+// rateLimitStep is a request counted against a rule at offset from the start of a test.
+type rateLimitStep struct {
+	offset        time.Duration
+	wantAllowed   bool
+	wantRemaining int
+}
+
+// rateLimitStart is on a whole second, so the 1s fixed windows of the tests start with it.
+var rateLimitStart = time.Unix(1_700_000_000, 0)
+
+func runRateLimitSteps(t *testing.T, store rateLimitStore, rule rateLimitRule, steps []rateLimitStep) {
+	t.Helper()
+	for i, step := range steps {
+		res, err := store.take(context.Background(), "key", rule, rateLimitStart.Add(step.offset))
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if res.allowed != step.wantAllowed || res.remaining != step.wantRemaining {
+			t.Errorf("step %d at %v: allowed = %v, remaining = %d, want %v, %d",
+				i, step.offset, res.allowed, res.remaining, step.wantAllowed, step.wantRemaining)
+		}
+	}
+}
+
+// rateLimitTests are shared by the tests of every store, which must agree.
+var rateLimitTests = []struct {
+	name  string
+	rule  rateLimitRule
+	steps []rateLimitStep
+}{
+	{
+		name: "token bucket burst then refill",
+		rule: rateLimitRule{algorithm: "token-bucket", limit: 10, burst: 3, window: time.Second},
+		steps: []rateLimitStep{
+			{0, true, 2},
+			{0, true, 1},
+			{0, true, 0},
+			{0, false, 0},
+			{50 * time.Millisecond, false, 0}, // Half a token.
+			{100 * time.Millisecond, true, 0},
+			{time.Second, true, 2}, // Full again, capped at burst.
+		},
+	},
+	{
+		name: "token bucket slow rate",
+		rule: rateLimitRule{algorithm: "token-bucket", limit: 1, burst: 1, window: time.Minute},
+		steps: []rateLimitStep{
+			{0, true, 0},
+			{30 * time.Second, false, 0},
+			{time.Minute, true, 0},
+		},
+	},
+	{
+		name: "sliding window",
+		rule: rateLimitRule{algorithm: "sliding-window", limit: 4, window: time.Second},
+		steps: []rateLimitStep{
+			{0, true, 3},
+			{100 * time.Millisecond, true, 2},
+			{200 * time.Millisecond, true, 1},
+			{300 * time.Millisecond, true, 0},
+			{900 * time.Millisecond, false, 0},
+			// Half of the previous window's 4 requests still count.
+			{1500 * time.Millisecond, true, 1},
+			{1500 * time.Millisecond, true, 0},
+			{1500 * time.Millisecond, false, 0},
+			// Two windows later, nothing counts anymore.
+			{3 * time.Second, true, 3},
+		},
+	},
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	for _, tt := range rateLimitTests {
+		t.Run(tt.name, func(t *testing.T) {
+			runRateLimitSteps(t, newMemoryRateLimitStore(), tt.rule, tt.steps)
+		})
+	}
+}
+
+func TestTokenBucketResult(t *testing.T) {
+	rule := rateLimitRule{limit: 10, burst: 5, window: time.Second}
+	tests := []struct {
+		tokens    float64
+		allowed   bool
+		remaining int
+		reset     time.Duration
+		retry     time.Duration
+	}{
+		{4, true, 4, 100 * time.Millisecond, 0},
+		{0, true, 0, 500 * time.Millisecond, 0},
+		{0.5, false, 0, 450 * time.Millisecond, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		res := tokenBucketResult(rule, tt.tokens, tt.allowed)
+		if res.remaining != tt.remaining || res.reset != tt.reset || res.retry != tt.retry || res.limit != rule.burst {
+			t.Errorf("tokenBucketResult(%v, %v) = %+v, want remaining %d, reset %v, retry %v",
+				tt.tokens, tt.allowed, res, tt.remaining, tt.reset, tt.retry)
+		}
+	}
+}
+
+func TestMemoryRateLimitStoreSweep(t *testing.T) {
+	m := newMemoryRateLimitStore()
+	m.lastSweep = rateLimitStart
+	rule := rateLimitRule{algorithm: "token-bucket", limit: 1, burst: 1, window: time.Second}
+	window := rateLimitRule{algorithm: "sliding-window", limit: 1, window: time.Second}
+	m.take(context.Background(), "bucket", rule, rateLimitStart)
+	m.take(context.Background(), "window", window, rateLimitStart)
+
+	m.take(context.Background(), "other", rule, rateLimitStart.Add(rateLimitSweepInterval))
+	if _, ok := m.buckets["bucket"]; ok {
+		t.Error("full token bucket not swept")
+	}
+	if _, ok := m.windows["window"]; ok {
+		t.Error("expired sliding window not swept")
+	}
+	if _, ok := m.buckets["other"]; !ok {
+		t.Error("token bucket in use swept")
+	}
+}
+
+func TestRateLimitClientKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   rateLimitRule
+		header string
+		want   string
+	}{
+		{"ip", rateLimitRule{key: "ip"}, "", "ip:192.0.2.1"},
+		{"route", rateLimitRule{key: "route"}, "", "route:/api/items"},
+		{"header", rateLimitRule{key: "header", header: "X-API-Key"}, "secret", "header:secret"},
+		{"missing header falls back to ip", rateLimitRule{key: "header", header: "X-API-Key"}, "", "ip:192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+			r.RemoteAddr = "192.0.2.1:4321"
+			if tt.header != "" {
+				r.Header.Set("X-API-Key", tt.header)
+			}
+			if got := tt.rule.clientKey(r); got != tt.want {
+				t.Errorf("clientKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRateLimiterDefaults(t *testing.T) {
+	l := newRateLimiter(config.ServiceType{
+		Name:       "svc",
+		RateLimits: []config.RateLimitConfig{{Limit: 5}, {Name: "keyed", Key: "header:X-API-Key", Algorithm: "sliding-window", Limit: 10, Burst: 20, Window: "1m"}},
+	}, newMemoryRateLimitStore())
+	want := []rateLimitRule{
+		{name: "rule-0", key: "ip", algorithm: "token-bucket", limit: 5, burst: 5, window: defaultRateLimitWindow},
+		{name: "keyed", key: "header", header: "X-API-Key", algorithm: "sliding-window", limit: 10, burst: 20, window: time.Minute},
+	}
+	for i := range want {
+		if l.rules[i] != want[i] {
+			t.Errorf("rule %d = %+v, want %+v", i, l.rules[i], want[i])
+		}
+	}
+	if newRateLimiter(config.ServiceType{}, nil) != nil {
+		t.Error("rate limiter built for a service without rate limits")
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := newRateLimiter(config.ServiceType{
+		Name: "svc",
+		RateLimits: []config.RateLimitConfig{
+			{Name: "loose", Limit: 100},
+			{Name: "tight", Limit: 2, Window: "10s"},
+		},
+	}, newMemoryRateLimitStore())
+	tests := []struct {
+		wantAllowed   bool
+		wantRemaining string
+	}{
+		{true, "1"},
+		{true, "0"},
+		{false, "0"},
+	}
+	for i, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if got := l.allow(w, r, false); got != tt.wantAllowed {
+			t.Fatalf("request %d: allow() = %v, want %v", i, got, tt.wantAllowed)
+		}
+		// The headers describe the tightest rule.
+		if got := w.Header().Get("RateLimit-Limit"); got != "2" {
+			t.Errorf("request %d: RateLimit-Limit = %q, want 2", i, got)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != tt.wantRemaining {
+			t.Errorf("request %d: RateLimit-Remaining = %q, want %s", i, got, tt.wantRemaining)
+		}
+		if !tt.wantAllowed {
+			if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+				t.Errorf("request %d: status %d, Retry-After %q, want 429 with Retry-After", i, w.Code, w.Header().Get("Retry-After"))
+			}
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+// Defaults of the Redis rate limit store.
+const (
+	defaultRedisTimeout   = 100 * time.Millisecond
+	defaultRedisKeyPrefix = "lb:ratelimit:"
+	redisMaxIdleConns     = 16
+)
+
+// redisTokenBucketScript refills and takes from a token bucket stored in a hash, in
+// one atomic step. Numbers are returned as strings, as Redis truncates Lua numbers.
+const redisTokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1]) or burst
+local last = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate) + 1000)
+return {allowed, tostring(tokens)}
+`
+
+// redisSlidingWindowScript counts a request in the current fixed window (KEYS[1]) if
+// the weighted count with the previous one (KEYS[2]) is under the limit.
+const redisSlidingWindowScript = `
+local limit = tonumber(ARGV[1])
+local weight = tonumber(ARGV[2])
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+local previous = tonumber(redis.call('GET', KEYS[2]) or '0')
+local count = previous * weight + current
+local allowed = 0
+if count < limit then
+  redis.call('INCR', KEYS[1])
+  redis.call('PEXPIRE', KEYS[1], ARGV[3])
+  count = count + 1
+  allowed = 1
+end
+return {allowed, tostring(count)}
+`
+
+// redisRateLimitStore keeps rate limits in Redis (or any server speaking its protocol),
+// so every replica of the load balancer counts against the same quotas. Each request
+// runs a Lua script, which keeps the read-modify-write atomic across replicas.
+// Replicas use their own clocks, which must be kept in sync (e.g. by NTP).
+type redisRateLimitStore struct {
+	client *redisClient
+	prefix string
+}
+
+func newRedisRateLimitStore(conf config.RedisConfig) *redisRateLimitStore {
+	prefix := conf.KeyPrefix
+	if prefix == "" {
+		prefix = defaultRedisKeyPrefix
+	}
+	return &redisRateLimitStore{
+		client: &redisClient{
+			address:  conf.Address,
+			password: conf.Password,
+			db:       conf.DB,
+			timeout:  parseTimeout(conf.Timeout, defaultRedisTimeout),
+			idle:     make(chan *redisConn, redisMaxIdleConns),
+		},
+		prefix: prefix,
+	}
+}
+
+func (s *redisRateLimitStore) take(ctx context.Context, key string, rule rateLimitRule, now time.Time) (rateLimitResult, error) {
+	key = s.prefix + key
+	if rule.algorithm == "sliding-window" {
+		start := now.Truncate(rule.window)
+		elapsed := now.Sub(start)
+		reply, err := s.client.eval(ctx, redisSlidingWindowScript,
+			[]string{key + ":" + strconv.FormatInt(start.UnixMilli(), 10), key + ":" + strconv.FormatInt(start.Add(-rule.window).UnixMilli(), 10)},
+			strconv.Itoa(rule.limit),
+			strconv.FormatFloat(slidingWindowWeight(rule, elapsed), 'f', -1, 64),
+			strconv.FormatInt((2*rule.window).Milliseconds(), 10),
+		)
+		if err != nil {
+			return rateLimitResult{}, err
+		}
+		allowed, count, err := parseRedisScriptReply(reply)
+		if err != nil {
+			return rateLimitResult{}, err
+		}
+		return slidingWindowResult(rule, count, allowed, elapsed), nil
+	}
+
+	rate := float64(rule.limit) / float64(rule.window.Milliseconds()) // Tokens per millisecond.
+	reply, err := s.client.eval(ctx, redisTokenBucketScript, []string{key},
+		strconv.FormatFloat(rate, 'f', -1, 64),
+		strconv.Itoa(rule.burst),
+		strconv.FormatInt(now.UnixMilli(), 10),
+	)
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	allowed, tokens, err := parseRedisScriptReply(reply)
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	return tokenBucketResult(rule, tokens, allowed), nil
+}
+
+func (s *redisRateLimitStore) close() {
+	s.client.close()
+}
+
+// parseRedisScriptReply parses the {allowed, number} reply of the rate limit scripts.
+func parseRedisScriptReply(reply any) (bool, float64, error) {
+	values, ok := reply.([]any)
+	if !ok || len(values) != 2 {
+		return false, 0, fmt.Errorf("unexpected redis reply %v", reply)
+	}
+	allowed, ok1 := values[0].(int64)
+	number, ok2 := values[1].(string)
+	if !ok1 || !ok2 {
+		return false, 0, fmt.Errorf("unexpected redis reply %v", reply)
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed == 1, n, nil
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisClient is a minimal client for the Redis protocol (RESP2), with a small pool
+// of idle connections. It covers what the rate limit store needs, nothing more.
+type redisClient struct {
+	address  string
+	password string
+	db       int
+	timeout  time.Duration // Bounds dialing and each command.
+	idle     chan *redisConn
+	closed   atomic.Bool
+}
+
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// eval runs a Lua script, by its SHA1 digest when the server has it cached.
+func (c *redisClient) eval(ctx context.Context, script string, keys []string, args ...string) (any, error) {
+	digest := sha1.Sum([]byte(script))
+	cmd := append([]string{"EVALSHA", hex.EncodeToString(digest[:]), strconv.Itoa(len(keys))}, keys...)
+	cmd = append(cmd, args...)
+	reply, err := c.do(ctx, cmd...)
+	var redisErr redisError
+	if errors.As(err, &redisErr) && strings.HasPrefix(string(redisErr), "NOSCRIPT") {
+		cmd[0], cmd[1] = "EVAL", script
+		return c.do(ctx, cmd...)
+	}
+	return reply, err
+}
+
+// do sends a command and reads its reply. Error replies are returned as redisError,
+// and leave the connection usable.
+func (c *redisClient) do(ctx context.Context, args ...string) (any, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	reply, err := conn.command(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return reply, err
+}
+
+// get returns an idle connection, or dials a new one.
+func (c *redisClient) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	dialer := net.Dialer{Timeout: c.timeout}
+	nc, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, reader: bufio.NewReader(nc)}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if c.password != "" {
+		if _, err := conn.command("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.command("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// put returns a connection to the pool, or closes it when the pool is full.
+func (c *redisClient) put(conn *redisConn) {
+	if c.closed.Load() {
+		conn.Close()
+		return
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// close closes the idle connections. Connections in use are closed when they are put back.
+func (c *redisClient) close() {
+	c.closed.Store(true)
+	for {
+		select {
+		case conn := <-c.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// command writes a command as an array of bulk strings and reads the reply.
+func (conn *redisConn) command(args ...string) (any, error) {
+	var buf []byte
+	buf = fmt.Appendf(buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return readRedisReply(conn.reader)
+}
+
+// readRedisReply reads a RESP2 reply: simple strings and bulk strings are returned as
+// string, integers as int64, arrays as []any and nil replies as nil.
+func readRedisReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed redis reply %q", line)
+	}
+	payload := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil || n < 0 {
+			return nil, err // $-1 is a nil reply.
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil || n < 0 {
+			return nil, err // *-1 is a nil reply.
+		}
+		values := make([]any, n)
+		for i := range values {
+			if values[i], err = readRedisReply(r); err != nil {
+				var redisErr redisError
+				if !errors.As(err, &redisErr) {
+					return nil, err
+				}
+				values[i] = redisErr
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unknown redis reply type %q", line[0])
+	}
+}
@@ -0,0 +1,387 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+func TestReadRedisReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    any
+		wantErr string
+	}{
+		{name: "simple string", input: "+OK\r\n", want: "OK"},
+		{name: "error", input: "-NOSCRIPT No matching script\r\n", wantErr: "redis: NOSCRIPT No matching script"},
+		{name: "integer", input: ":42\r\n", want: int64(42)},
+		{name: "negative integer", input: ":-3\r\n", want: int64(-3)},
+		{name: "bulk string", input: "$5\r\nhello\r\n", want: "hello"},
+		{name: "bulk string with CRLF", input: "$4\r\na\r\nb\r\n", want: "a\r\nb"},
+		{name: "empty bulk string", input: "$0\r\n\r\n", want: ""},
+		{name: "nil bulk string", input: "$-1\r\n", want: nil},
+		{name: "array", input: "*2\r\n:1\r\n$3\r\n2.5\r\n", want: []any{int64(1), "2.5"}},
+		{name: "nested array", input: "*2\r\n*1\r\n+a\r\n$-1\r\n", want: []any{[]any{"a"}, nil}},
+		{name: "error in array", input: "*2\r\n-ERR bad\r\n:1\r\n", want: []any{redisError("ERR bad"), int64(1)}},
+		{name: "nil array", input: "*-1\r\n", want: nil},
+		{name: "unknown type", input: "?x\r\n", wantErr: "unknown redis reply type"},
+		{name: "missing CR", input: "+OK\n", wantErr: "malformed redis reply"},
+		{name: "bad integer", input: ":x\r\n", wantErr: "invalid syntax"},
+		{name: "short bulk string", input: "$5\r\nhi\r\n", wantErr: "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readRedisReply(bufio.NewReader(strings.NewReader(tt.input)))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reply = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRedisScriptReply(t *testing.T) {
+	tests := []struct {
+		reply       any
+		wantAllowed bool
+		wantNumber  float64
+		wantErr     bool
+	}{
+		{[]any{int64(1), "2.5"}, true, 2.5, false},
+		{[]any{int64(0), "0"}, false, 0, false},
+		{[]any{int64(1)}, false, 0, true},
+		{[]any{"1", "2"}, false, 0, true},
+		{[]any{int64(1), "x"}, false, 0, true},
+		{"OK", false, 0, true},
+	}
+	for _, tt := range tests {
+		allowed, n, err := parseRedisScriptReply(tt.reply)
+		if (err != nil) != tt.wantErr || allowed != tt.wantAllowed || n != tt.wantNumber {
+			t.Errorf("parseRedisScriptReply(%#v) = %v, %v, %v", tt.reply, allowed, n, err)
+		}
+	}
+}
+
+func TestRedisCommandEncoding(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &redisConn{Conn: client, reader: bufio.NewReader(client)}
+	sent := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 256)
+		n, _ := server.Read(buf)
+		sent <- string(buf[:n])
+		server.Write([]byte("+OK\r\n"))
+	}()
+	reply, err := conn.command("SET", "key", "a b\r\n")
+	if err != nil || reply != "OK" {
+		t.Fatalf("command() = %v, %v", reply, err)
+	}
+	if got, want := <-sent, "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\na b\r\n\r\n"; got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+// fakeRedis is an in-process server speaking enough of the Redis protocol for the rate
+// limit store. Lua is not available, so it runs Go versions of the store's scripts,
+// which it recognizes by digest: changing a script fails the tests until its version
+// here is changed too.
+type fakeRedis struct {
+	t        *testing.T
+	ln       net.Listener
+	password string
+
+	mux      sync.Mutex
+	scripts  map[string]string // By SHA1 digest, once sent with EVAL.
+	hashes   map[string]map[string]string
+	strings  map[string]string
+	commands []string // Names of the commands received, in order.
+	dbs      []string // Databases selected.
+	conns    int
+}
+
+// newFakeRedis starts a fake server, which requires password when it is not empty.
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		t:        t,
+		ln:       ln,
+		password: password,
+		scripts:  make(map[string]string),
+		hashes:   make(map[string]map[string]string),
+		strings:  make(map[string]string),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	f.mux.Lock()
+	f.conns++
+	f.mux.Unlock()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		req, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		args, ok := req.([]any)
+		if !ok || len(args) == 0 {
+			conn.Write([]byte("-ERR protocol error\r\n"))
+			continue
+		}
+		cmd := make([]string, len(args))
+		for i, a := range args {
+			cmd[i], _ = a.(string)
+		}
+		name := strings.ToUpper(cmd[0])
+		f.mux.Lock()
+		f.commands = append(f.commands, name)
+		var reply string
+		switch {
+		case name == "AUTH":
+			if len(cmd) == 2 && cmd[1] == f.password {
+				authed = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case name == "SELECT":
+			f.dbs = append(f.dbs, cmd[1])
+			reply = "+OK\r\n"
+		case name == "EVAL":
+			digest := sha1.Sum([]byte(cmd[1]))
+			f.scripts[hex.EncodeToString(digest[:])] = cmd[1]
+			reply = f.eval(cmd[1], cmd[2:])
+		case name == "EVALSHA":
+			if script, ok := f.scripts[cmd[1]]; ok {
+				reply = f.eval(script, cmd[2:])
+			} else {
+				reply = "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+			}
+		default:
+			reply = "-ERR unknown command '" + cmd[0] + "'\r\n"
+		}
+		f.mux.Unlock()
+		conn.Write([]byte(reply))
+	}
+}
+
+// eval runs a script given "numkeys key... arg...". The caller must hold f.mux.
+func (f *fakeRedis) eval(script string, args []string) string {
+	n, _ := strconv.Atoi(args[0])
+	keys, argv := args[1:1+n], args[1+n:]
+	num := func(s string) float64 {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			f.t.Errorf("script argument %q is not a number", s)
+		}
+		return v
+	}
+	var allowed int
+	var number float64
+	switch script {
+	case redisTokenBucketScript:
+		rate, burst, now := num(argv[0]), num(argv[1]), num(argv[2])
+		state := f.hashes[keys[0]]
+		tokens, last := burst, now
+		if state != nil {
+			tokens, last = num(state["tokens"]), num(state["last"])
+		}
+		tokens = math.Min(burst, tokens+math.Max(0, now-last)*rate)
+		if tokens >= 1 {
+			tokens--
+			allowed = 1
+		}
+		f.hashes[keys[0]] = map[string]string{"tokens": luaNumber(tokens), "last": luaNumber(now)}
+		number = tokens
+	case redisSlidingWindowScript:
+		limit, weight := num(argv[0]), num(argv[1])
+		current, previous := 0.0, 0.0
+		if v, ok := f.strings[keys[0]]; ok {
+			current = num(v)
+		}
+		if v, ok := f.strings[keys[1]]; ok {
+			previous = num(v)
+		}
+		number = previous*weight + current
+		if number < limit {
+			f.strings[keys[0]] = luaNumber(current + 1)
+			number++
+			allowed = 1
+		}
+	default:
+		return "-ERR unknown script\r\n"
+	}
+	s := luaNumber(number)
+	return fmt.Sprintf("*2\r\n:%d\r\n$%d\r\n%s\r\n", allowed, len(s), s)
+}
+
+// luaNumber formats n like tostring does in the Lua of Redis.
+func luaNumber(n float64) string {
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
+
+func (f *fakeRedis) commandLog() []string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+func (f *fakeRedis) connections() int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.conns
+}
+
+func newTestRedisStore(f *fakeRedis, conf config.RedisConfig) *redisRateLimitStore {
+	conf.Address = f.ln.Addr().String()
+	conf.Timeout = "1s"
+	return newRedisRateLimitStore(conf)
+}
+
+func TestRedisRateLimitStore(t *testing.T) {
+	for _, tt := range rateLimitTests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestRedisStore(newFakeRedis(t, ""), config.RedisConfig{})
+			defer store.close()
+			runRateLimitSteps(t, store, tt.rule, tt.steps)
+		})
+	}
+}
+
+func TestRedisRateLimitStoreKeys(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store := newTestRedisStore(f, config.RedisConfig{KeyPrefix: "test:"})
+	defer store.close()
+	ctx := context.Background()
+	store.take(ctx, "bucket", rateLimitRule{algorithm: "token-bucket", limit: 1, burst: 1, window: time.Second}, rateLimitStart)
+	store.take(ctx, "window", rateLimitRule{algorithm: "sliding-window", limit: 1, window: time.Second}, rateLimitStart)
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if _, ok := f.hashes["test:bucket"]; !ok {
+		t.Errorf("token bucket keys = %v, want test:bucket", f.hashes)
+	}
+	window := "test:window:" + strconv.FormatInt(rateLimitStart.UnixMilli(), 10)
+	if _, ok := f.strings[window]; !ok {
+		t.Errorf("sliding window keys = %v, want %s", f.strings, window)
+	}
+}
+
+func TestRedisEvalFallsBackFromEvalsha(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store := newTestRedisStore(f, config.RedisConfig{})
+	defer store.close()
+	rule := rateLimitRule{algorithm: "token-bucket", limit: 10, burst: 10, window: time.Second}
+	for range 3 {
+		if _, err := store.take(context.Background(), "key", rule, rateLimitStart); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The script is sent once, then run by digest.
+	want := []string{"EVALSHA", "EVAL", "EVALSHA", "EVALSHA"}
+	if got := f.commandLog(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %v, want %v", got, want)
+	}
+	if n := f.connections(); n != 1 {
+		t.Errorf("connections = %d, want 1 reused for every command", n)
+	}
+}
+
+func TestRedisAuthAndSelect(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	rule := rateLimitRule{algorithm: "token-bucket", limit: 1, burst: 1, window: time.Second}
+
+	store := newTestRedisStore(f, config.RedisConfig{Password: "secret", DB: 2})
+	defer store.close()
+	if _, err := store.take(context.Background(), "key", rule, rateLimitStart); err != nil {
+		t.Fatal(err)
+	}
+	f.mux.Lock()
+	if got := f.commands; len(got) < 2 || got[0] != "AUTH" || got[1] != "SELECT" || f.dbs[0] != "2" {
+		t.Errorf("commands = %v, databases = %v, want AUTH then SELECT 2", got, f.dbs)
+	}
+	f.mux.Unlock()
+
+	wrong := newTestRedisStore(f, config.RedisConfig{Password: "wrong"})
+	defer wrong.close()
+	var redisErr redisError
+	if _, err := wrong.take(context.Background(), "key", rule, rateLimitStart); !errors.As(err, &redisErr) {
+		t.Errorf("err = %v, want a WRONGPASS reply", err)
+	}
+}
+
+func TestRedisErrorReplyKeepsConnection(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store := newTestRedisStore(f, config.RedisConfig{})
+	defer store.close()
+	ctx := context.Background()
+	if _, err := store.client.do(ctx, "NOPE"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Fatalf("err = %v, want unknown command", err)
+	}
+	if reply, err := store.client.eval(ctx, redisSlidingWindowScript, []string{"a", "b"}, "1", "0", "1000"); err != nil {
+		t.Fatalf("eval() = %v, %v", reply, err)
+	}
+	if n := f.connections(); n != 1 {
+		t.Errorf("connections = %d, want 1", n)
+	}
+}
+
+func TestRedisUnreachableFailsOpen(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	store := newRedisRateLimitStore(config.RedisConfig{Address: addr, Timeout: "100ms"})
+	defer store.close()
+	l := newRateLimiter(config.ServiceType{Name: "svc", RateLimits: []config.RateLimitConfig{{Limit: 1}}}, store)
+	for i := range 3 {
+		if !l.allow(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), false) {
+			t.Fatalf("request %d denied while the store is unreachable", i)
+		}
+	}
+}
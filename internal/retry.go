@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+// Defaults of retries.
+const (
+	defaultRetryBudget       = 0.2 // Retries allowed per successful request.
+	defaultRetryBudgetWindow = 10 * time.Second
+	retryBudgetBuckets       = 10 // Slices of the budget window.
+)
+
+// defaultRetryStatuses are the backend responses retried by default.
+var defaultRetryStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// Outcomes of retries, used as the "outcome" metric label.
+const (
+	retryOutcomeAllowed = "allowed" // The request was retried.
+	retryOutcomeDenied  = "denied"  // The budget was exhausted, the failure was returned.
+)
+
+// retryBucket counts the successful requests and the retries of a slice of the window.
+type retryBucket struct {
+	start     time.Time
+	successes int
+	retries   int
+}
+
+// retrier retries failed requests on other backends of a service. Retries come out of
+// a budget shared by the requests of the service: a fraction of the successful requests
+// over a rolling window, plus a minimum rate. When most requests fail the budget dries
+// up, so retries do not pile onto a service that is already struggling.
+// A nil *retrier never retries.
+type retrier struct {
+	service      string
+	attempts     int
+	statuses     []int
+	budget       float64 // Retries earned per successful request.
+	minPerSecond float64
+	window       time.Duration
+
+	mux     sync.Mutex
+	buckets [retryBudgetBuckets]retryBucket
+}
+
+// newRetrier builds the retrier of a service, or returns nil when it does not retry.
+func newRetrier(serviceConf config.ServiceType) *retrier {
+	conf := serviceConf.Retries
+	if conf.Attempts <= 0 {
+		return nil
+	}
+	rt := &retrier{
+		service:      serviceConf.Name,
+		attempts:     conf.Attempts,
+		statuses:     conf.Statuses,
+		budget:       conf.BudgetPercent / 100,
+		minPerSecond: conf.MinPerSecond,
+		window:       parseTimeout(conf.BudgetWindow, defaultRetryBudgetWindow),
+	}
+	if len(rt.statuses) == 0 {
+		rt.statuses = defaultRetryStatuses
+	}
+	if rt.budget <= 0 {
+		rt.budget = defaultRetryBudget
+	}
+	return rt
+}
+
+// retryable reports whether the outcome of an attempt is worth retrying elsewhere.
+func (rt *retrier) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return slices.Contains(rt.statuses, resp.StatusCode)
+}
+
+// success counts a successful request, which adds to the retry budget.
+func (rt *retrier) success() {
+	if rt == nil {
+		return
+	}
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	rt.bucket(time.Now()).successes++
+}
+
+// spend takes a retry from the budget, if there is one left.
+func (rt *retrier) spend() bool {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	now := time.Now()
+	var successes, retries int
+	for _, b := range rt.buckets {
+		if now.Sub(b.start) < rt.window {
+			successes += b.successes
+			retries += b.retries
+		}
+	}
+	if float64(retries) >= rt.budget*float64(successes)+rt.minPerSecond*rt.window.Seconds() {
+		return false
+	}
+	rt.bucket(now).retries++
+	return true
+}
+
+// bucket returns the bucket of the slice of the window at now, resetting it when it
+// last counted an older slice. The caller must hold rt.mux.
+func (rt *retrier) bucket(now time.Time) *retryBucket {
+	width := max(rt.window/retryBudgetBuckets, 1) // Tiny windows would divide by zero.
+	start := now.Truncate(width)
+	b := &rt.buckets[(start.UnixNano()/int64(width))%retryBudgetBuckets]
+	if !b.start.Equal(start) {
+		*b = retryBucket{start: start}
+	}
+	return b
+}
+
+// roundTrip sends the request to the first backend, and retries it on other backends
+// while it fails, the service allows more attempts and the budget has retries left.
+func (ur *upstreamRequest) roundTrip(base http.RoundTripper, req *http.Request) (*http.Response, error) {
+	resp, err := ur.send(base, req)
+	rt := ur.service.retrier
+	if !ur.retry {
+		return resp, err
+	}
+
+	// The slot of the first backend is released by the service, those of the other
+	// attempts here, or once the body of their response is closed.
+	tried := []*Backend{ur.primary}
+	recorded := false // The result of the last attempt is in its circuit breaker.
+	if ur.hedgeAnswered != nil {
+		tried, recorded = append(tried, ur.hedgeAnswered), true
+	}
+	release := func() {}
+	for range rt.attempts {
+		if !rt.retryable(resp, err) || ur.inbound.Context().Err() != nil {
+			break
+		}
+		b := ur.service.acquireOther(ur.inbound, tried)
+		if b == nil {
+			break
+		}
+		if !rt.spend() {
+			ur.service.releaseBackend(b)
+			RetriesTotal.WithLabelValues(rt.service, retryOutcomeDenied).Inc()
+			break
+		}
+		RetriesTotal.WithLabelValues(rt.service, retryOutcomeAllowed).Inc()
+
+		// Give up on the previous attempt, and let its breaker know it failed.
+		if resp != nil {
+			resp.Body.Close()
+		}
+		release()
+		if !recorded {
+			tried[len(tried)-1].breaker.record(true, 0)
+		}
+		recorded = false
+		ur.primaryRecorded = true
+		tried = append(tried, b)
+
+		var retryReq *http.Request
+		retryReq, release = ur.retarget(req, b)
+		resp, err = b.transport.RoundTrip(retryReq)
+	}
+
+	if len(tried) > 1 && !recorded {
+		tried[len(tried)-1].breaker.record(err != nil || resp.StatusCode >= 500, 0)
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if len(tried) > 1 {
+		resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	}
+	return resp, nil
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+func TestRetrierBudget(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        config.RetryConfig
+		successes   int
+		wantRetries int
+	}{
+		{"no successes", config.RetryConfig{Attempts: 1}, 0, 0},
+		{"default budget", config.RetryConfig{Attempts: 1}, 10, 2},
+		{"budget percent", config.RetryConfig{Attempts: 1, BudgetPercent: 50}, 10, 5},
+		{"min per second", config.RetryConfig{Attempts: 1, MinPerSecond: 1, BudgetWindow: "3s"}, 0, 3},
+		{"budget and min per second", config.RetryConfig{Attempts: 1, MinPerSecond: 1, BudgetWindow: "3s"}, 10, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newRetrier(config.ServiceType{Name: t.Name(), Retries: tt.conf})
+			for range tt.successes {
+				rt.success()
+			}
+			retries := 0
+			for rt.spend() {
+				retries++
+				if retries > 100 {
+					t.Fatal("budget never runs out")
+				}
+			}
+			if retries != tt.wantRetries {
+				t.Errorf("retries = %d, want %d", retries, tt.wantRetries)
+			}
+		})
+	}
+}
+
+func TestRetrierTinyWindow(t *testing.T) {
+	rt := newRetrier(config.ServiceType{Retries: config.RetryConfig{Attempts: 1, BudgetWindow: "5ns"}})
+	rt.success() // Used to divide by zero.
+	rt.spend()
+}
+
+func TestRetrierRetryable(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		status   int
+		err      error
+		want     bool
+	}{
+		{"error", nil, 0, errors.New("connection refused"), true},
+		{"default status", nil, http.StatusBadGateway, nil, true},
+		{"default success", nil, http.StatusOK, nil, false},
+		{"internal error not retried by default", nil, http.StatusInternalServerError, nil, false},
+		{"configured status", []int{http.StatusInternalServerError}, http.StatusInternalServerError, nil, true},
+		{"default status not configured", []int{http.StatusInternalServerError}, http.StatusBadGateway, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newRetrier(config.ServiceType{Retries: config.RetryConfig{Attempts: 1, Statuses: tt.statuses}})
+			var resp *http.Response
+			if tt.err == nil {
+				resp = &http.Response{StatusCode: tt.status}
+			}
+			if got := rt.retryable(resp, tt.err); got != tt.want {
+				t.Errorf("retryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNilRetrier(t *testing.T) {
+	if newRetrier(config.ServiceType{}) != nil {
+		t.Error("retrier built for a service without retries")
+	}
+	var rt *retrier
+	rt.success()
+}
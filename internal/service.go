@@ -1,13 +1,20 @@
 package internal
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"hash/crc32"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,24 +25,60 @@ import (
 
 // Backend represents a single backend server that a service can route requests to.
 type Backend struct {
-	URL          *url.URL           // The URL of the backend server.
+	URL          *url.URL               // The URL of the backend server.
+	socketPath   string                 // Path of the Unix socket the backend listens on, if any.
+	ServiceName  string                 // Name of the service the backend belongs to, used as a metric label.
 	ReverseProxy *httputil.ReverseProxy // The reverse proxy configured to forward requests to this backend.
-	Alive        bool               // Current liveness status of the backend (true if alive, false otherwise).
-	mux          sync.RWMutex       // Mutex to protect access to the Alive status.
-	ActiveConns  int64              // Atomic counter for active connections, used by least-connections algorithm.
+	transport    *http.Transport        // The connection pool to the backend, also used for health checks.
+	checkPool    *http.Transport        // The connection pool of health checks: transport, unless they speak another protocol.
+	Alive        bool                   // Current liveness status of the backend (true if alive, false otherwise).
+	mux          sync.RWMutex           // Mutex to protect access to the Alive status.
+	ActiveConns  int64                  // Atomic counter for active connections, used by least-connections algorithm.
+	pooledConns  atomic.Int64           // Requests that got a connection from the transport.
+	reusedConns  atomic.Int64           // Requests that got an idle pooled connection.
+	breaker      *circuitBreaker        // Nil when the service has no circuit breaker.
+	maxConns     int64                  // Limit of ActiveConns for HTTP requests (0 = no limit).
+	// Upgraded (e.g. WebSocket) connections, tracked apart from ActiveConns:
+	upgrades   map[*upgradedConn]struct{}
+	upgradeMux sync.Mutex
+	// Consecutive successful and failed health checks. Backends kept by a config change
+	// are checked by the loops of both services for a moment, hence the mutex.
+	healthOK, healthFailed int
+	healthMux              sync.Mutex
+	admin                  atomic.Int32  // adminState, set with LoadBalancer.SetBackendState.
+	sticky                 stickyClients // Clients sent by ip-hash, which may keep coming while it drains.
+	weight                 atomic.Int64  // Relative share of the traffic, 0 meaning 1.
+	currentWeight          int64         // Smooth weighted round-robin state, guarded by Service.wrrMux.
 }
 
 // Service represents a load-balanced service with multiple backends and a specific load balancing algorithm.
 type Service struct {
-	Name        string
-	Backends    []*Backend
-	counter     uint64 // For Round Robin: atomic counter to keep track of the next backend to use.
-	Algorithm   string // The load balancing algorithm to use (e.g., "round-robin", "least-connections", "ip-hash").
-	HealthCheck config.HealthCheckConfig // Configuration for active health checks.
+	Name           string
+	Backends       []*Backend
+	counter        uint64                   // For Round Robin: atomic counter to keep track of the next backend to use.
+	Algorithm      string                   // The load balancing algorithm to use (e.g., "round-robin", "least-connections", "ip-hash").
+	Protocol       string                   // The application protocol spoken by the backends ("http", "grpc" or "tcp").
+	HealthCheck    config.HealthCheckConfig // Configuration for active health checks.
+	healthChecker  healthChecker            // Runs the checks configured by HealthCheck.
+	upgradeLimits  upgradeLimits            // Limits applied to upgraded (e.g. WebSocket) connections.
+	requestTimeout time.Duration            // Upper bound for a whole proxied request (0 = no limit).
+	queue          *requestQueue            // Requests waiting for a backend slot, nil without max_pending.
+	rateLimiter    *rateLimiter             // Nil when the service has no rate limits.
+	concurrency    *concurrencyLimiter      // Nil without adaptive concurrency limiting.
+	hedger         *hedger                  // Nil when requests are not hedged.
+	retrier        *retrier                 // Nil when requests are not retried.
+	faults         *faultInjector           // Nil when no faults are injected.
+	panicThreshold float64                  // Share of healthy backends under which health checks are ignored (0 = never).
+	panicking      atomic.Bool              // Set while in panic mode.
+	weighted       atomic.Bool              // Set when the backends do not all have the same weight.
+	wrrMux         sync.Mutex               // Guards the weighted round-robin state of the backends.
+	stop           chan struct{}            // Closed by Stop to end the health check loop.
+	conf           config.ServiceType       // The validated config the service was built from.
+	stopOnce       sync.Once
 	// For Consistent Hashing (ip-hash algorithm):
-	hashRing []uint32           // Sorted slice of hash values representing virtual nodes on the consistent hash ring.
+	hashRing []uint32            // Sorted slice of hash values representing virtual nodes on the consistent hash ring.
 	hashMap  map[uint32]*Backend // Maps hash values on the ring to actual backend instances.
-	ringMux  sync.RWMutex       // Mutex to protect access to hashRing and hashMap.
+	ringMux  sync.RWMutex        // Mutex to protect access to hashRing and hashMap.
 }
 
 func (b *Backend) SetAlive(alive bool) {
@@ -50,6 +93,15 @@ func (b *Backend) IsAlive() bool {
 	return b.Alive
 }
 
+// httpBase returns the scheme and host that requests made by the load balancer itself
+// (e.g. health checks) are sent to.
+func (b *Backend) httpBase() string {
+	if b.socketPath != "" {
+		return "http://" + unixHost
+	}
+	return b.URL.Scheme + "://" + b.URL.Host
+}
+
 func (b *Backend) IncConn() {
 	atomic.AddInt64(&b.ActiveConns, 1)
 }
@@ -58,11 +110,33 @@ func (b *Backend) DecConn() {
 	atomic.AddInt64(&b.ActiveConns, -1)
 }
 
+// GetWeight returns the relative share of the traffic the backend gets.
+func (b *Backend) GetWeight() int64 {
+	if w := b.weight.Load(); w > 0 {
+		return w
+	}
+	return 1
+}
+
+// updateWeighted records whether the backends have different weights, which makes
+// round-robin weighted.
+func (s *Service) updateWeighted() {
+	weighted := false
+	for _, b := range s.Backends {
+		if b.GetWeight() != s.Backends[0].GetWeight() {
+			weighted = true
+		}
+	}
+	s.weighted.Store(weighted)
+}
+
 func (b *Backend) GetActiveConns() int64 {
 	return atomic.LoadInt64(&b.ActiveConns)
 }
 
 // responseWriter is a wrapper around http.ResponseWriter to capture the status code.
+// It implements the optional http.Flusher, http.Hijacker and io.ReaderFrom interfaces,
+// so streaming responses and upgraded connections keep working through it.
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
@@ -77,88 +151,314 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Flush sends any buffered data to the client, which gRPC and SSE streams rely on.
+func (rw *responseWriter) Flush() {
+	http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+// Hijack lets the caller take over the client connection, e.g. for WebSockets.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(rw.ResponseWriter).Hijack()
+}
+
+// ReadFrom copies src to the client, using the optimized path of the underlying
+// writer (e.g. sendfile) when it has one.
+func (rw *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := rw.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	// Hide ReadFrom from io.Copy, which would otherwise call it again.
+	return io.Copy(struct{ io.Writer }{rw.ResponseWriter}, src)
+}
+
+// Unwrap returns the original http.ResponseWriter, so http.ResponseController can reach it.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// acceptsEventStream reports whether the client asks for Server-Sent Events.
+func acceptsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// isStreaming reports whether the response is a long-lived stream, such as
+// Server-Sent Events, whose duration says nothing about the backend latency.
+func (rw *responseWriter) isStreaming() bool {
+	mediaType, _, _ := strings.Cut(rw.Header().Get("Content-Type"), ";")
+	return strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream")
+}
+
+// ServeHTTP proxies the request to the backend. The caller holds one of the
+// backend's connection slots, taken with Service.acquireBackend.
 func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	b.IncConn()
-	ActiveConnections.WithLabelValues("", b.URL.String()).Inc()
-	defer func() {
-		b.DecConn()
-		ActiveConnections.WithLabelValues("", b.URL.String()).Dec()
-	}()
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), b.poolTrace()))
 	b.ReverseProxy.ServeHTTP(w, r)
 }
 
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Use a custom ResponseWriter to capture the status code
 	rw := newResponseWriter(w)
-	
+
 	// Start timer for request duration metric
 	start := time.Now()
 
-	backend := s.GetNextBackend(r)
-	if backend != nil {
-		backend.ServeHTTP(rw, r)
-		// Record metrics after the request has been served by the backend
-		statusCode := strconv.Itoa(rw.statusCode)
+	// Record metrics after the request has been served, also when the handler is
+	// aborted with http.ErrAbortHandler, e.g. by a reset fault. Streams are kept out of
+	// the request duration histogram, as they would drown the latency of regular requests.
+	defer func() {
+		statusCode := s.statusLabel(rw)
 		HttpRequestsTotal.WithLabelValues(s.Name, r.URL.Path, r.Method, statusCode).Inc()
-		HttpRequestDurationSeconds.WithLabelValues(s.Name, r.URL.Path, r.Method, statusCode).Observe(time.Since(start).Seconds())
-		return
+		if rw.isStreaming() {
+			HttpStreamDurationSeconds.WithLabelValues(s.Name, r.URL.Path, r.Method, statusCode).Observe(time.Since(start).Seconds())
+		} else {
+			HttpRequestDurationSeconds.WithLabelValues(s.Name, r.URL.Path, r.Method, statusCode).Observe(time.Since(start).Seconds())
+		}
+	}()
+
+	// Faults come first, so they apply to every request they match.
+	if s.faults.inject(rw, r, s.Protocol == "grpc") && s.rateLimiter.allow(rw, r, s.Protocol == "grpc") {
+		s.serveLimited(rw, r, start)
+	}
+}
+
+// proxy sends the request to a backend of the service, or answers it when none can
+// take it. start is when the service received the request.
+func (s *Service) proxy(rw *responseWriter, r *http.Request, start time.Time) {
+	// Streams are expected to outlive any request timeout.
+	if s.requestTimeout > 0 && !isUpgradeRequest(r) && !acceptsEventStream(r) {
+		ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	// Upgraded connections are long-lived and tracked on their own, so they do not
+	// take connection slots.
+	var backend *Backend
+	var upstream *upstreamRequest
+	rejected := false
+	if isUpgradeRequest(r) {
+		if backend = s.GetNextBackend(r); backend != nil && !backend.breaker.allow() {
+			backend = nil // Another request took the last half-open probe slot.
+		}
+	} else if backend, rejected = s.acquireBackend(r); backend != nil {
+		defer s.releaseBackend(backend)
+	}
+
+	if backend != nil && isUpgradeRequest(r) {
+		backend.serveUpgrade(rw, r, s.upgradeLimits)
+	} else if backend != nil {
+		var upstreamReq *http.Request
+		upstreamReq, upstream = s.withUpstream(r, backend)
+		backend.ServeHTTP(rw, upstreamReq)
+	} else if rejected {
+		// Every backend is busy: ask the client to come back later.
+		rw.Header().Set("Retry-After", s.queue.retryAfter())
+		if s.Protocol == "grpc" {
+			writeGrpcError(rw, grpcUnavailable, "upstream at capacity")
+		} else {
+			http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+		}
+	} else if s.Protocol == "grpc" {
+		writeGrpcError(rw, grpcUnavailable, "no healthy upstream")
+	} else {
+		http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+	}
+
+	if backend != nil && r.Context().Err() == context.Canceled {
+		backend.breaker.release()
+	} else if backend != nil {
+		// Clients going away say nothing about the backend, and streams are
+		// expected to be slow.
+		latency := time.Since(start)
+		if rw.isStreaming() || isUpgradeRequest(r) {
+			latency = 0
+		}
+		// Retries already told the breaker of the first backend it failed.
+		if upstream == nil || !upstream.primaryRecorded {
+			backend.breaker.record(s.failed(rw), latency)
+		}
+		if !s.failed(rw) {
+			s.retrier.success()
+		}
 	}
+}
 
-	http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
-	statusCode := strconv.Itoa(rw.statusCode)
-	HttpRequestsTotal.WithLabelValues(s.Name, r.URL.Path, r.Method, statusCode).Inc()
-	HttpRequestDurationSeconds.WithLabelValues(s.Name, r.URL.Path, r.Method, statusCode).Observe(time.Since(start).Seconds())
+// statusLabel returns the value of the "code" metric label for a served request.
+// For gRPC services it is the grpc-status reported by the backend, since the
+// HTTP status of a gRPC call is 200 even when the call fails.
+func (s *Service) statusLabel(rw *responseWriter) string {
+	if s.Protocol == "grpc" {
+		if status, ok := grpcStatus(rw.Header()); ok {
+			return grpcCodeLabel(status)
+		}
+	}
+	return strconv.Itoa(rw.statusCode)
+}
+
+// failed reports whether a served request counts as a backend failure for the circuit
+// breaker: a 5xx response, or for gRPC services a status telling the backend is unwell.
+func (s *Service) failed(rw *responseWriter) bool {
+	if s.Protocol == "grpc" {
+		if status, ok := grpcStatus(rw.Header()); ok {
+			code, _ := strconv.Atoi(status)
+			return code == grpcDeadlineExceeded || code == grpcInternal || code == grpcUnavailable
+		}
+	}
+	return rw.statusCode >= 500
+}
+
+// usable reports whether a backend may be picked for new traffic: it is active, passes
+// health checks (or the service panics), its circuit is not open and it is below
+// max_connections.
+func (s *Service) usable(b *Backend) bool {
+	return b.adminState() == adminActive && s.healthy(b) && b.breaker.ready() && b.hasCapacity()
+}
+
+// pickable reports whether a backend is usable and not excluded from a pick.
+func (s *Service) pickable(b *Backend, exclude []*Backend) bool {
+	return s.usable(b) && !slices.Contains(exclude, b)
+}
+
+// healthy reports whether traffic may go to the backend as far as health checks go.
+// While the service panics, every backend may get traffic.
+func (s *Service) healthy(b *Backend) bool {
+	return b.IsAlive() || s.panicking.Load()
+}
+
+// updatePanicMode enters panic mode when the share of backends passing health checks
+// drops below the panic threshold, and leaves it when enough of them are back. It is
+// better to send traffic to all backends then, as health checks are more likely to be
+// wrong (e.g. a bad health check path) than every backend failing at once.
+func (s *Service) updatePanicMode() {
+	if s.panicThreshold <= 0 || len(s.Backends) == 0 || s.stopped() {
+		return // Stopped services leave the gauge to the one replacing them.
+	}
+	alive := 0
+	for _, b := range s.Backends {
+		if b.IsAlive() {
+			alive++
+		}
+	}
+	healthy := float64(alive) / float64(len(s.Backends))
+	panicking := healthy < s.panicThreshold
+	if s.panicking.Swap(panicking) == panicking {
+		return
+	}
+	if panicking {
+		ServicePanicMode.WithLabelValues(s.Name).Set(1)
+		logger.Warn("HealthCheck", "PANIC MODE: too few healthy backends, ignoring health checks and routing to all backends",
+			"service", s.Name, "healthy", alive, "backends", len(s.Backends), "threshold", s.panicThreshold)
+	} else {
+		ServicePanicMode.WithLabelValues(s.Name).Set(0)
+		logger.Info("HealthCheck", "Panic mode over, routing to healthy backends again", "service", s.Name, "healthy", alive)
+	}
 }
 
 // GetNextBackend selects the next available backend based on the configured load balancing algorithm.
 // It takes an http.Request as input, which might be used by certain algorithms (e.g., IP Hash).
 func (s *Service) GetNextBackend(r *http.Request) *Backend {
+	return s.GetNextBackendForAddr(r.RemoteAddr)
+}
+
+// GetNextBackendForAddr selects the next available backend for a client connecting
+// from remoteAddr, so services that are not HTTP can share the same algorithms.
+func (s *Service) GetNextBackendForAddr(remoteAddr string) *Backend {
+	return s.nextBackend(remoteAddr, nil)
+}
+
+// nextBackend selects a backend like GetNextBackendForAddr, other than the excluded
+// ones. Excluding backends makes it the pick of an extra attempt of a request already
+// balanced, a hedge or a retry: round-robin then leaves its state alone, so extra
+// attempts do not skew the picks of other requests.
+func (s *Service) nextBackend(remoteAddr string, exclude []*Backend) *Backend {
 	switch s.Algorithm {
 	case "least-connections":
-		return s.leastConnections()
+		return s.leastConnections(exclude)
 	case "ip-hash":
-		return s.ipHash(r)
+		return s.ipHash(remoteAddr, exclude)
 	case "round-robin":
 		fallthrough
 	default:
-		return s.roundRobin()
+		return s.roundRobin(exclude)
 	}
 }
 
 // roundRobin implements the Round Robin load balancing algorithm.
 // It atomically increments a counter and cycles through the backends to select the next alive one.
-func (s *Service) roundRobin() *Backend {
+func (s *Service) roundRobin(exclude []*Backend) *Backend {
 	count := len(s.Backends)
 	if count == 0 {
 		return nil
 	}
+	if s.weighted.Load() {
+		return s.weightedRoundRobin(exclude)
+	}
 
-	start := atomic.AddUint64(&s.counter, 1)
+	var start uint64
+	if len(exclude) == 0 {
+		start = atomic.AddUint64(&s.counter, 1)
+	} else {
+		start = atomic.LoadUint64(&s.counter) + 1 // Without taking the turn of the next request.
+	}
 	// Iterate through backends starting from 'start' to find an alive one.
 	// This ensures that even if some backends are down, the load balancer attempts to find an available one.
 	for i := 0; i < count; i++ {
 		idx := (int(start) + i) % count
-		if s.Backends[idx].IsAlive() {
+		if s.pickable(s.Backends[idx], exclude) {
 			return s.Backends[idx]
 		}
 	}
 	return nil // No alive backend found
 }
 
+// weightedRoundRobin is the smooth weighted round-robin of nginx: every pick, each
+// usable backend earns its weight, and the richest one is picked and pays the total.
+// Backends get picked in proportion to their weights, evenly spread out.
+func (s *Service) weightedRoundRobin(exclude []*Backend) *Backend {
+	s.wrrMux.Lock()
+	defer s.wrrMux.Unlock()
+	var best *Backend
+	if len(exclude) > 0 {
+		// Extra attempts get the backend that would come next, without paying for it.
+		for _, b := range s.Backends {
+			if s.pickable(b, exclude) && (best == nil || b.currentWeight+b.GetWeight() > best.currentWeight+best.GetWeight()) {
+				best = b
+			}
+		}
+		return best
+	}
+	var total int64
+	for _, b := range s.Backends {
+		if !s.usable(b) {
+			continue
+		}
+		w := b.GetWeight()
+		b.currentWeight += w
+		total += w
+		if best == nil || b.currentWeight > best.currentWeight {
+			best = b
+		}
+	}
+	if best != nil {
+		best.currentWeight -= total
+	}
+	return best
+}
+
 // leastConnections implements the Least Connections load balancing algorithm.
-// It selects the backend with the fewest active connections among the alive backends.
-func (s *Service) leastConnections() *Backend {
+// It selects the backend with the fewest active connections per unit of weight among the alive backends.
+func (s *Service) leastConnections(exclude []*Backend) *Backend {
 	var best *Backend
-	min := int64(-1) // Initialize with -1 to ensure the first alive backend is chosen.
+	var bestConns, bestWeight int64
 
 	for _, b := range s.Backends {
-		if !b.IsAlive() {
-			continue // Skip dead backends
+		if !s.pickable(b, exclude) {
+			continue // Skip dead backends and open circuits
 		}
-		conns := b.GetActiveConns()
-		if min == -1 || conns < min {
-			min = conns
-			best = b
+		// conns/weight < bestConns/bestWeight, without dividing.
+		conns, weight := b.GetActiveConns(), b.GetWeight()
+		if best == nil || conns*bestWeight < bestConns*weight {
+			best, bestConns, bestWeight = b, conns, weight
 		}
 	}
 	return best
@@ -167,15 +467,19 @@ func (s *Service) leastConnections() *Backend {
 // ipHash implements the IP Hash (Consistent Hashing) load balancing algorithm.
 // It uses the client's IP address to consistently route requests to the same backend.
 // If the hash ring is empty, it falls back to round-robin.
-func (s *Service) ipHash(r *http.Request) *Backend {
+func (s *Service) ipHash(remoteAddr string, exclude []*Backend) *Backend {
 	s.ringMux.RLock() // Protect hash ring access
 	defer s.ringMux.RUnlock()
 
 	if len(s.hashRing) == 0 {
-		return s.roundRobin() // Fallback if hash ring is not initialized or empty
+		return s.roundRobin(exclude) // Fallback if hash ring is not initialized or empty
 	}
 
-	ip := r.RemoteAddr
+	// Only hash the IP: the source port changes with every connection.
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
 	hash := crc32.ChecksumIEEE([]byte(ip)) // Compute hash of the client's IP
 
 	// Find the backend on the hash ring (closest clockwise virtual node)
@@ -183,28 +487,44 @@ func (s *Service) ipHash(r *http.Request) *Backend {
 		return s.hashRing[i] >= hash
 	})
 
-	if idx == len(s.hashRing) {
-		idx = 0 // Wrap around to the beginning of the ring
+	// Walk the ring clockwise past backends that failed since the ring was built, whose
+	// circuit is open or that are full, so their clients move to the same neighbour
+	// meanwhile. Draining backends only
+	// keep the clients they served recently.
+	for i := 0; i < len(s.hashRing); i++ {
+		b := s.hashMap[s.hashRing[(idx+i)%len(s.hashRing)]]
+		state := b.adminState()
+		if state == adminDisabled || !s.healthy(b) || !b.breaker.ready() || !b.hasCapacity() || slices.Contains(exclude, b) {
+			continue
+		}
+		if state == adminDraining && !b.sticky.recent(ip) {
+			continue
+		}
+		b.sticky.record(ip)
+		return b
 	}
-
-	return s.hashMap[s.hashRing[idx]]
+	return nil
 }
 
 // UpdateHashRing builds or updates the consistent hash ring based on the currently alive backends.
 // It creates multiple virtual nodes for each alive backend to improve distribution.
+// While the service panics, every backend is on the ring.
 func (s *Service) UpdateHashRing() {
+	s.updatePanicMode()
+
 	s.ringMux.Lock() // Protect hash ring modification
 	defer s.ringMux.Unlock()
 
 	s.hashRing = []uint32{}
 	s.hashMap = make(map[uint32]*Backend)
 
-	// Add alive backends to the hash ring with multiple virtual nodes.
+	// Add alive backends to the hash ring with multiple virtual nodes, three per unit of weight.
 	for _, b := range s.Backends {
-		if b.IsAlive() {
-			for i := 0; i < 3; i++ {
+		// Draining backends stay on the ring, for the clients already sticking to them.
+		if s.healthy(b) && b.adminState() != adminDisabled {
+			for i := 0; i < 3*int(b.GetWeight()); i++ {
 				key := fmt.Sprintf("%s-%d", b.URL.String(), i) // Create unique key for virtual node
-				hash := crc32.ChecksumIEEE([]byte(key))    // Compute hash for the virtual node
+				hash := crc32.ChecksumIEEE([]byte(key))        // Compute hash for the virtual node
 				s.hashRing = append(s.hashRing, hash)
 				s.hashMap[hash] = b
 			}
@@ -219,6 +539,13 @@ func (s *Service) UpdateHashRing() {
 // StartHealthCheck initializes and runs periodic health checks for the backends of a service.
 // If health checks are disabled, all backends are initially marked as alive.
 func (s *Service) StartHealthCheck() {
+	s.checkHealth(s.Backends)
+	s.runHealthChecks()
+}
+
+// checkHealth runs the initial health check of StartHealthCheck, limited to the
+// backends given: the others keep their status.
+func (s *Service) checkHealth(unchecked []*Backend) {
 	if !s.HealthCheck.Enabled {
 		// If health checks are disabled, mark all backends as alive and update the hash ring.
 		for _, b := range s.Backends {
@@ -228,41 +555,66 @@ func (s *Service) StartHealthCheck() {
 		return
 	}
 
-	// Perform an initial health check when the service starts.
-	s.checkBackends()
+	// Perform an initial health check when the service starts. Its results apply at
+	// once, rather than after the thresholds are reached.
+	s.checkBackends(unchecked)
+}
 
-	// Parse the health check interval, defaulting to 10 seconds if parsing fails.
-	interval, err := time.ParseDuration(s.HealthCheck.Interval)
-	if err != nil {
-		interval = 10 * time.Second
+// runHealthChecks checks each backend on its own schedule, until the service is
+// stopped. A service replacing another runs them once that one is stopped, so the
+// backends they share are never checked by both.
+func (s *Service) runHealthChecks() {
+	if !s.HealthCheck.Enabled {
+		// The checks of the service replaced may have failed shared backends meanwhile.
+		for _, b := range s.Backends {
+			b.SetAlive(true)
+		}
+		s.UpdateHashRing()
+		return
 	}
+	policy := newHealthPolicy(s.HealthCheck)
+	for _, b := range s.Backends {
+		go s.healthCheckLoop(b, policy)
+	}
+}
 
-	// Start a goroutine to periodically check backend health.
-	ticker := time.NewTicker(interval)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				s.checkBackends()
-			}
-		}
-	}()
+// Stop ends the background work of the service, such as its health checks.
+// It is called when the service is replaced by a config reload.
+func (s *Service) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// stopped reports whether the service was stopped.
+func (s *Service) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
 }
 
-// checkBackends iterates through all backends and updates their liveness status based on health check results.
+// checkBackends checks the backends once, concurrently, and applies the results right away.
 // If a backend's status changes, it logs the event and triggers an update to the consistent hash ring.
-func (s *Service) checkBackends() {
+func (s *Service) checkBackends(backends []*Backend) {
+	results := make([]bool, len(backends))
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = s.probe(b)
+		}()
+	}
+	wg.Wait()
+
 	changed := false
-	for _, b := range s.Backends {
-		alive := isBackendAlive(b.URL, s.HealthCheck.Path)
-		if b.IsAlive() != alive {
-			b.SetAlive(alive)
+	for i, b := range backends {
+		if alive := results[i]; b.IsAlive() != alive {
+			s.setAlive(b, alive)
 			changed = true
-			status := "down"
-			if alive {
-				status = "up"
-			}
-			logger.Info("HealthCheck", "Backend status changed", "backend", b.URL.String(), "status", status)
 		}
 	}
 	if changed {
@@ -270,28 +622,33 @@ func (s *Service) checkBackends() {
 	}
 }
 
-// isBackendAlive performs a simple HTTP HEAD or GET request to a backend to determine its liveness.
-// It returns true if the backend responds with a 2xx, 3xx, or 4xx status code within a 2-second timeout, false otherwise.
-func isBackendAlive(u *url.URL, path string) bool {
-	// Configure an HTTP client with a short timeout to prevent blocking indefinitely.
-	client := http.Client{
-		Timeout: 2 * time.Second,
+// probe runs one health check of the backend, within
+// the global cap on checks in flight. Should the service stop while it waits for its
+// turn, the backend keeps its status.
+func (s *Service) probe(b *Backend) bool {
+	release, ok := healthProbes.acquire(s.stop)
+	if !ok {
+		return b.IsAlive()
 	}
-	// Construct the full target URL for the health check.
-	target := u.Scheme + "://" + u.Host + path
+	defer release()
 
-	// Attempt a HEAD request first, as it's generally lighter.
-	resp, err := client.Head(target)
-	if err != nil {
-		// If HEAD fails, fallback to a GET request.
-		resp, err = client.Get(target)
-		if err != nil {
-			return false // Both HEAD and GET failed, backend is considered down.
-		}
+	start := time.Now()
+	alive := s.healthChecker.alive(b)
+	result := "unhealthy"
+	if alive {
+		result = "healthy"
 	}
-	defer resp.Body.Close()
+	HealthCheckDurationSeconds.WithLabelValues(s.Name, b.URL.String()).Observe(time.Since(start).Seconds())
+	HealthChecksTotal.WithLabelValues(s.Name, b.URL.String(), result).Inc()
+	return alive
+}
 
-	// Consider the backend alive if the status code is between 200 and 499 (inclusive).
-	// This broadly covers successful responses and client-side errors, indicating the server is reachable.
-	return resp.StatusCode >= 200 && resp.StatusCode < 500
+// setAlive changes the status of a backend and logs it. The caller updates the hash ring.
+func (s *Service) setAlive(b *Backend, alive bool) {
+	b.SetAlive(alive)
+	status := "down"
+	if alive {
+		status = "up"
+	}
+	logger.Info("HealthCheck", "Backend status changed", "backend", b.URL.String(), "status", status)
 }
@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+// newTestService builds a service without health checks, so every backend is alive.
+func newTestService(t *testing.T, conf config.ServiceType) *Service {
+	t.Helper()
+	conf.Name = t.Name()
+	if conf.UrlPath == "" {
+		conf.UrlPath = "/"
+	}
+	if len(conf.Backends) == 0 {
+		conf.Backends = []string{"http://a", "http://b", "http://c"}
+	}
+	s := newService(conf, newMemoryRateLimitStore(), nil)
+	s.runHealthChecks()
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func TestNextBackendExcludes(t *testing.T) {
+	tests := []struct {
+		name string
+		conf config.ServiceType
+	}{
+		{"round-robin", config.ServiceType{Algorithm: "round-robin"}},
+		{"weighted round-robin", config.ServiceType{Algorithm: "round-robin", Weights: map[string]int{"http://a": 3}}},
+		{"least-connections", config.ServiceType{Algorithm: "least-connections"}},
+		{"ip-hash", config.ServiceType{Algorithm: "ip-hash"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, tt.conf)
+			for _, excluded := range s.Backends {
+				for range 10 {
+					b := s.nextBackend("192.0.2.1:1234", []*Backend{excluded})
+					if b == nil || b == excluded {
+						t.Fatalf("nextBackend excluding %s = %v", excluded.URL, b)
+					}
+				}
+			}
+			if b := s.nextBackend("192.0.2.1:1234", s.Backends); b != nil {
+				t.Errorf("nextBackend excluding every backend = %s, want nil", b.URL)
+			}
+		})
+	}
+}
+
+func TestNextBackendExtraPicksKeepRotation(t *testing.T) {
+	tests := []struct {
+		name string
+		conf config.ServiceType
+	}{
+		{"round-robin", config.ServiceType{}},
+		{"weighted round-robin", config.ServiceType{Weights: map[string]int{"http://a": 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain, extra := newTestService(t, tt.conf), newTestService(t, tt.conf)
+			for i := range 12 {
+				want := plain.GetNextBackendForAddr("")
+				got := extra.GetNextBackendForAddr("")
+				if got.URL.String() != want.URL.String() {
+					t.Fatalf("pick %d = %s, want %s", i, got.URL, want.URL)
+				}
+				// A retry of every request must not change the picks of the next ones.
+				extra.nextBackend("", []*Backend{got})
+			}
+		})
+	}
+}
+
+func TestAcquireOther(t *testing.T) {
+	s := newTestService(t, config.ServiceType{
+		Backends:       []string{"http://a", "http://b"},
+		CircuitBreaker: config.BreakerConfig{Enabled: true, MinRequests: 1},
+	})
+	r := httptest.NewRequest("GET", "/", nil)
+	a, b := s.Backends[0], s.Backends[1]
+
+	got := s.acquireOther(r, []*Backend{a})
+	if got != b || b.GetActiveConns() != 1 {
+		t.Fatalf("acquireOther = %v with %d active conns, want %s with 1", got, b.GetActiveConns(), b.URL)
+	}
+	s.releaseBackend(got)
+
+	a.admin.Store(int32(adminDraining))
+	if got := s.acquireOther(r, []*Backend{b}); got != nil {
+		t.Errorf("acquireOther picked draining backend %s", got.URL)
+	}
+	a.admin.Store(int32(adminActive))
+
+	// Extra attempts leave circuits that are not closed alone.
+	b.breaker.allow()
+	b.breaker.record(true, 0)
+	if got := s.acquireOther(r, []*Backend{a}); got != nil {
+		t.Errorf("acquireOther picked %s with an open circuit", got.URL)
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+		want    string // Backends picked in a row, by the last letter of their URL.
+	}{
+		{"equal weights", nil, "bcabca"},
+		{"smooth", map[string]int{"http://a": 5}, "aabacaa" + "aabacaa"},
+		{"spread", map[string]int{"http://a": 2, "http://b": 2}, "abcab" + "abcab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, config.ServiceType{Weights: tt.weights})
+			got := ""
+			for range tt.want {
+				b := s.GetNextBackendForAddr("")
+				got += b.URL.Host
+			}
+			if got != tt.want {
+				t.Errorf("picks = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPHash(t *testing.T) {
+	s := newTestService(t, config.ServiceType{Algorithm: "ip-hash", Backends: []string{"http://a", "http://b", "http://c", "http://d"}})
+	addrs := make([]string, 200)
+	picks := make(map[string]*Backend)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		picks[addrs[i]] = s.GetNextBackendForAddr(addrs[i] + ":1234")
+		if b := s.GetNextBackendForAddr(addrs[i] + ":4321"); b != picks[addrs[i]] {
+			t.Fatalf("client %s moved from %s to %s with another source port", addrs[i], picks[addrs[i]].URL, b.URL)
+		}
+	}
+	counts := make(map[*Backend]int)
+	for _, b := range picks {
+		counts[b]++
+	}
+	if len(counts) != len(s.Backends) {
+		t.Errorf("clients spread over %d backends, want %d", len(counts), len(s.Backends))
+	}
+
+	// Only the clients of a backend that goes down move, even before the ring is rebuilt
+	// without it.
+	down := s.Backends[0]
+	down.SetAlive(false)
+	for _, rebuilt := range []bool{false, true} {
+		if rebuilt {
+			s.UpdateHashRing()
+		}
+		for _, addr := range addrs {
+			b := s.GetNextBackendForAddr(addr + ":1234")
+			if b == down || (picks[addr] != down && b != picks[addr]) {
+				t.Errorf("client %s moved from %s to %s (ring rebuilt: %v)", addr, picks[addr].URL, b.URL, rebuilt)
+			}
+		}
+	}
+}
+
+func TestIPHashWeights(t *testing.T) {
+	s := newTestService(t, config.ServiceType{
+		Algorithm: "ip-hash",
+		Backends:  []string{"http://a", "http://b"},
+		Weights:   map[string]int{"http://a": 4},
+	})
+	nodes := make(map[*Backend]int)
+	for _, b := range s.hashMap {
+		nodes[b]++
+	}
+	if nodes[s.Backends[0]] != 12 || nodes[s.Backends[1]] != 3 {
+		t.Errorf("virtual nodes = %d and %d, want 12 and 3", nodes[s.Backends[0]], nodes[s.Backends[1]])
+	}
+
+	heavy := 0
+	const clients = 2000
+	for i := range clients {
+		if s.GetNextBackendForAddr(fmt.Sprintf("10.%d.%d.1:1", i/256, i%256)) == s.Backends[0] {
+			heavy++
+		}
+	}
+	if heavy < clients/2 {
+		t.Errorf("backend with weight 4 got %d of %d clients, want most of them", heavy, clients)
+	}
+}
+
+func TestUpdatePanicMode(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold float64
+		changes   []string // Backends of a, b and c going up ("a+") or down ("a-").
+		want      string   // Panic mode after each change: "p" panicking, "." not.
+	}{
+		{"no threshold", 0, []string{"a-", "b-", "c-"}, "..."},
+		{"enters below threshold", 50, []string{"a-", "b-", "c-"}, ".pp"},
+		{"leaves when backends are back", 50, []string{"a-", "b-", "a+", "b+"}, ".p.."},
+		{"every backend down", 100, []string{"a-", "a+"}, "p."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t, config.ServiceType{PanicThreshold: tt.threshold})
+			got := ""
+			for _, change := range tt.changes {
+				s.setAlive(s.Backends[change[0]-'a'], change[1] == '+')
+				s.UpdateHashRing()
+				if s.panicking.Load() {
+					got += "p"
+				} else {
+					got += "."
+				}
+			}
+			if got != tt.want {
+				t.Errorf("panic modes = %s, want %s", got, tt.want)
+			}
+			gauge := fmt.Sprintf("service_panic_mode{service=%q} 0", s.Name)
+			if s.panicking.Load() {
+				gauge = fmt.Sprintf("service_panic_mode{service=%q} 1", s.Name)
+			}
+			if !strings.Contains(scrapeMetrics(), gauge) {
+				t.Errorf("metrics do not contain %s", gauge)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/logger"
+)
+
+// adminState is the administrative state of a backend, set by operators apart from
+// the health checks. It is also used as the value of the state gauge.
+type adminState int32
+
+const (
+	adminActive   adminState = iota // The backend takes traffic, if healthy.
+	adminDraining                   // The backend only takes sticky clients, and finishes its requests.
+	adminDisabled                   // The backend takes no new traffic at all.
+)
+
+func (s adminState) String() string {
+	switch s {
+	case adminDraining:
+		return "draining"
+	case adminDisabled:
+		return "disabled"
+	default:
+		return "active"
+	}
+}
+
+// parseAdminState parses the name of an administrative state.
+func parseAdminState(name string) (adminState, error) {
+	for _, s := range []adminState{adminActive, adminDraining, adminDisabled} {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown backend state %q, want active, draining or disabled", name)
+}
+
+// adminState returns the administrative state of the backend.
+func (b *Backend) adminState() adminState {
+	return adminState(b.admin.Load())
+}
+
+// stickyClientTTL is how long a client keeps reaching a draining backend by ip-hash
+// after its last request to it.
+const stickyClientTTL = 10 * time.Minute
+
+// stickyClients remembers the clients ip-hash recently sent to a backend, by IP, so
+// those of a draining backend keep reaching it while new ones go elsewhere.
+type stickyClients struct {
+	mux       sync.Mutex
+	clients   map[string]time.Time // Last request of each client.
+	lastSweep time.Time
+}
+
+// recent reports whether the client was sent to the backend within stickyClientTTL.
+func (sc *stickyClients) recent(client string) bool {
+	sc.mux.Lock()
+	defer sc.mux.Unlock()
+	seen, ok := sc.clients[client]
+	return ok && time.Since(seen) < stickyClientTTL
+}
+
+// record remembers a request of the client, and forgets the clients not seen for
+// stickyClientTTL, once per TTL.
+func (sc *stickyClients) record(client string) {
+	now := time.Now()
+	sc.mux.Lock()
+	defer sc.mux.Unlock()
+	if sc.clients == nil {
+		sc.clients = make(map[string]time.Time)
+	}
+	sc.clients[client] = now
+	if now.Sub(sc.lastSweep) < stickyClientTTL {
+		return
+	}
+	for c, seen := range sc.clients {
+		if now.Sub(seen) >= stickyClientTTL {
+			delete(sc.clients, c)
+		}
+	}
+	sc.lastSweep = now
+}
+
+// adminStates remembers the backends that are not active, by service name and backend
+// URL, so their state survives config reloads, which rebuild every Backend.
+type adminStates struct {
+	mux      sync.RWMutex
+	states   map[backendKey]adminState
+	exported map[backendKey]bool // Backends with a state gauge.
+}
+
+// backendKey names a backend of a service across config reloads.
+type backendKey struct {
+	service, backend string
+}
+
+// set records the state of a backend, and exports it.
+func (a *adminStates) set(service, backend string, state adminState) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	key := backendKey{service, backend}
+	a.export(key, state)
+	if state == adminActive {
+		delete(a.states, key)
+		return
+	}
+	if a.states == nil {
+		a.states = make(map[backendKey]adminState)
+	}
+	a.states[key] = state
+}
+
+// export sets the state gauge of a backend. The caller must hold a.mux for writing.
+func (a *adminStates) export(key backendKey, state adminState) {
+	if a.exported == nil {
+		a.exported = make(map[backendKey]bool)
+	}
+	a.exported[key] = true
+	BackendAdminState.WithLabelValues(key.service, key.backend).Set(float64(state))
+}
+
+// apply gives the backends of a service that is not serving yet their recorded state.
+func (a *adminStates) apply(svc *Service) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	changed := false
+	for _, b := range svc.Backends {
+		key := backendKey{svc.Name, b.URL.String()}
+		if state, ok := a.states[key]; ok {
+			b.admin.Store(int32(state))
+			a.export(key, state)
+			changed = true
+		}
+	}
+	if changed {
+		svc.UpdateHashRing()
+	}
+}
+
+// pruneAdminStates forgets the states of backends no longer configured, so a backend
+// removed while disabled does not come back disabled, and drops their state gauges.
+// The caller must hold lb.mux.
+func (lb *LoadBalancer) pruneAdminStates() {
+	configured := make(map[backendKey]bool)
+	for _, svc := range lb.allServices() {
+		for _, b := range svc.Backends {
+			configured[backendKey{svc.Name, b.URL.String()}] = true
+		}
+	}
+	a := &lb.adminStates
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for key := range a.states {
+		if !configured[key] {
+			delete(a.states, key)
+		}
+	}
+	for key := range a.exported {
+		if !configured[key] {
+			BackendAdminState.DeleteLabelValues(key.service, key.backend)
+			delete(a.exported, key)
+		}
+	}
+}
+
+// SetBackendState sets the administrative state of a backend of the named service:
+// "active", "draining" or "disabled". The state is kept across config reloads while the
+// backend stays configured. It returns the requests and the upgraded connections still
+// in flight to the backend: draining lets both finish, disabling closes the upgraded
+// connections gracefully.
+func (lb *LoadBalancer) SetBackendState(service, backend, state string) (int64, int, error) {
+	s, err := parseAdminState(state)
+	if err != nil {
+		return 0, 0, err
+	}
+	lb.mux.RLock()
+	defer lb.mux.RUnlock()
+
+	svc, b := lb.findBackend(service, backend)
+	if b == nil {
+		return 0, 0, fmt.Errorf("no backend %q in service %q", backend, service)
+	}
+	lb.adminStates.set(service, backend, s)
+	b.admin.Store(int32(s))
+	svc.UpdateHashRing() // Disabled backends leave the ring, draining ones keep their clients.
+
+	inFlight, upgrades := b.GetActiveConns(), b.GetActiveUpgrades()
+	if s == adminDisabled {
+		go b.CloseUpgrades(context.Background(), upgradeClosedDrain)
+	}
+	logger.Info("SetBackendState", "Backend state changed", "service", service, "backend", backend, "state", s.String(),
+		"in_flight", inFlight, "upgraded", upgrades)
+	return inFlight, upgrades, nil
+}
+
+// allServices returns the HTTP, TCP and UDP services. The caller must hold lb.mux.
+func (lb *LoadBalancer) allServices() []*Service {
+	services := make([]*Service, 0, len(lb.Services)+len(lb.TCPProxies)+len(lb.UDPProxies))
+	for _, svc := range lb.Services {
+		services = append(services, svc)
+	}
+	for _, p := range lb.TCPProxies {
+		services = append(services, p.service.Load())
+	}
+	for _, p := range lb.UDPProxies {
+		services = append(services, p.service.Load())
+	}
+	return services
+}
+
+// findBackend looks a backend up by service name and URL. The caller must hold lb.mux.
+func (lb *LoadBalancer) findBackend(service, backend string) (*Service, *Backend) {
+	for _, svc := range lb.allServices() {
+		if svc.Name != service {
+			continue
+		}
+		for _, b := range svc.Backends {
+			if b.URL.String() == backend {
+				return svc, b
+			}
+		}
+	}
+	return nil, nil
+}
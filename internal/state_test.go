@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+func TestSetBackendStateUpgrades(t *testing.T) {
+	backend := newEchoBackend(t)
+	lb := newTestLoadBalancer(t, config.ConfigType{Services: []config.ServiceType{
+		{Name: "ws", UrlPath: "/", Backends: []string{backend.URL}},
+	}})
+	front := httptest.NewServer(lb.GetServices("/"))
+	defer front.Close()
+	conn, reader := dialUpgrade(t, front.Listener.Addr().String())
+	b := lb.GetServices("/").Backends[0]
+	for b.GetActiveUpgrades() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Draining lets the upgraded connection run, and reports it.
+	inFlight, upgrades, err := lb.SetBackendState("ws", backend.URL, "draining")
+	if err != nil || inFlight != 0 || upgrades != 1 {
+		t.Fatalf("SetBackendState(draining) = %d, %d, %v; want 0, 1, nil", inFlight, upgrades, err)
+	}
+	io.WriteString(conn, "ping")
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(reader, got); err != nil || string(got) != "ping" {
+		t.Fatalf("echo while draining = %q, %v; want ping", got, err)
+	}
+
+	// Disabling closes it.
+	if _, _, err := lb.SetBackendState("ws", backend.URL, "disabled"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(reader); err != nil {
+		t.Errorf("upgraded connection not closed by disabling its backend: %v", err)
+	}
+}
+
+func TestIPHashDrainingKeepsRecentClients(t *testing.T) {
+	s := newTestService(t, config.ServiceType{Algorithm: "ip-hash"})
+	draining := s.Backends[0]
+	var sticky []string
+	for i := range 100 {
+		addr := fmt.Sprintf("10.0.0.%d", i)
+		if s.GetNextBackendForAddr(addr+":1234") == draining {
+			sticky = append(sticky, addr)
+		}
+	}
+	if len(sticky) < 2 {
+		t.Fatalf("%d clients sent to the first backend, want a few", len(sticky))
+	}
+
+	draining.admin.Store(int32(adminDraining))
+	s.UpdateHashRing()
+	for _, addr := range sticky {
+		if b := s.GetNextBackendForAddr(addr + ":4321"); b != draining {
+			t.Errorf("client %s of the draining backend moved to %s", addr, b.URL)
+		}
+	}
+	for i := range 100 {
+		addr := fmt.Sprintf("10.0.1.%d", i)
+		if s.GetNextBackendForAddr(addr+":1234") == draining {
+			t.Errorf("new client %s sent to the draining backend", addr)
+		}
+	}
+
+	// Clients not seen for a while are new ones.
+	draining.sticky.mux.Lock()
+	draining.sticky.clients[sticky[0]] = time.Now().Add(-stickyClientTTL)
+	draining.sticky.mux.Unlock()
+	if b := s.GetNextBackendForAddr(sticky[0] + ":1234"); b == draining {
+		t.Errorf("client %s still sent to the draining backend after %v", sticky[0], stickyClientTTL)
+	}
+}
+
+func TestAdminStatesAcrossChanges(t *testing.T) {
+	lb := newTestLoadBalancer(t, config.ConfigType{Services: []config.ServiceType{
+		{Name: "states", UrlPath: "/", Backends: []string{"http://a", "http://b"}},
+	}})
+	gauge := `backend_admin_state{backend="http://a",service="states"}`
+	change := func(f func(s *config.ServiceType)) {
+		t.Helper()
+		if err := lb.UpdateConfig(func(conf *config.ConfigType) error {
+			f(&conf.Services[0])
+			return nil
+		}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := func() string {
+		if _, b := lb.findBackend("states", "http://a"); b != nil {
+			return b.adminState().String()
+		}
+		return "removed"
+	}
+
+	if _, _, err := lb.SetBackendState("states", "http://a", "disabled"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(scrapeMetrics(), gauge+" 2") {
+		t.Errorf("metrics do not contain %s 2", gauge)
+	}
+
+	tests := []struct {
+		name   string
+		change func(s *config.ServiceType)
+		want   string
+		gauge  bool // The state gauge of the backend is exported.
+	}{
+		// New Backends are built when their transport settings change.
+		{"backends rebuilt", func(s *config.ServiceType) { s.Timeouts.Dial = "1s" }, "disabled", true},
+		{"other backend removed", func(s *config.ServiceType) { s.Backends = []string{"http://a"} }, "disabled", true},
+		{"backend removed", func(s *config.ServiceType) { s.Backends = []string{"http://b"} }, "removed", false},
+		{"backend added back", func(s *config.ServiceType) { s.Backends = []string{"http://a", "http://b"} }, "active", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			change(tt.change)
+			if got := state(); got != tt.want {
+				t.Errorf("state = %s, want %s", got, tt.want)
+			}
+			if got := strings.Contains(scrapeMetrics(), gauge); got != tt.gauge {
+				t.Errorf("state gauge exported = %v, want %v", got, tt.gauge)
+			}
+		})
+	}
+}
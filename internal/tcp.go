@@ -0,0 +1,309 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+	"github.com/vinit-chauhan/load-balancer/logger"
+)
+
+const (
+	// tcpDialTimeout bounds how long connecting to a TCP backend may take.
+	tcpDialTimeout = 2 * time.Second
+	// tcpRemovedTimeout bounds how long the connections of a removed TCP service may
+	// keep running, like the shutdown of the load balancer does.
+	tcpRemovedTimeout = 30 * time.Second
+)
+
+// TCPProxy relays connections accepted on a listener to the backends of a TCP service.
+// The service is swapped in place on config reloads, so the listener keeps running.
+type TCPProxy struct {
+	Listen      string
+	service     atomic.Pointer[Service]
+	idleTimeout atomic.Int64          // time.Duration, 0 means no limit.
+	sendProxy   atomic.Value          // PROXY protocol version sent to backends ("", "v1" or "v2").
+	conf        config.TCPServiceType // As last applied, owned by config changes.
+	listener    net.Listener
+	conns       map[net.Conn]struct{} // Client and backend connections currently open.
+	connsMux    sync.Mutex
+	wg          sync.WaitGroup
+}
+
+// newTCPService builds the Service used to pick backends for a TCP service.
+func newTCPService(serviceConf config.TCPServiceType) *Service {
+	serviceConf.Validate() // Validate service configuration
+	backends := make([]*Backend, 0, len(serviceConf.Backends))
+	for _, backendURL := range serviceConf.Backends {
+		if !strings.Contains(backendURL, "://") {
+			backendURL = "tcp://" + backendURL
+		}
+		u, err := url.Parse(backendURL)
+		if err != nil || u.Port() == "" {
+			logger.Error("newTCPService", "error parsing backend address", "url", backendURL, "error", err)
+			continue
+		}
+		backends = append(backends, &Backend{
+			URL:         u,
+			ServiceName: serviceConf.Name,
+			Alive:       true,
+		})
+	}
+
+	svc := &Service{
+		Name:        serviceConf.Name,
+		Backends:    backends,
+		Algorithm:   serviceConf.Algorithm,
+		Protocol:    "tcp",
+		HealthCheck: serviceConf.HealthCheck,
+		stop:        make(chan struct{}),
+	}
+	svc.healthChecker = newHealthChecker(serviceConf.HealthCheck, svc.Protocol)
+	svc.StartHealthCheck()
+	svc.UpdateHashRing()
+	return svc
+}
+
+// newTCPProxy binds the listener of a TCP service, served once the proxy is started.
+// Accepting PROXY protocol is configured with the listener, and is not changed by
+// config reloads.
+func newTCPProxy(serviceConf config.TCPServiceType, admin *adminStates) (*TCPProxy, error) {
+	ln, err := net.Listen("tcp", serviceConf.Listen)
+	if err != nil {
+		return nil, err
+	}
+	pln, err := NewProxyProtoListener(ln, serviceConf.ProxyProtocol)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	p := &TCPProxy{
+		Listen:   serviceConf.Listen,
+		listener: pln,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	p.update(serviceConf, admin)
+	return p, nil
+}
+
+// start serves the connections accepted by the listener of the proxy.
+func (p *TCPProxy) start() {
+	go p.serve()
+	logger.Info("TCPProxy", "Listening for TCP service", "service", p.conf.Name, "listen", p.Listen)
+}
+
+// update replaces the service behind the proxy. Connections already established
+// keep using the backend they were given.
+func (p *TCPProxy) update(serviceConf config.TCPServiceType, admin *adminStates) {
+	idle, _ := time.ParseDuration(serviceConf.IdleTimeout)
+	p.idleTimeout.Store(int64(idle))
+	p.sendProxy.Store(serviceConf.SendProxyProtocol)
+	p.conf = serviceConf
+	svc := newTCPService(serviceConf)
+	admin.apply(svc)
+	if old := p.service.Swap(svc); old != nil {
+		old.Stop()
+	}
+}
+
+func (p *TCPProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Error("TCPProxy", "Accept error", "listen", p.Listen, "error", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.handle(conn)
+		}()
+	}
+}
+
+// handle relays a single client connection to a backend.
+func (p *TCPProxy) handle(client net.Conn) {
+	svc := p.service.Load()
+	if !p.track(client) {
+		client.Close()
+		return
+	}
+	defer p.untrack(client)
+
+	b := svc.GetNextBackendForAddr(client.RemoteAddr().String())
+	if b == nil {
+		logger.Error("TCPProxy", "No backend available", "service", svc.Name)
+		TCPConnectionErrorsTotal.WithLabelValues(svc.Name, "no_backend").Inc()
+		return
+	}
+	upstream, err := net.DialTimeout("tcp", b.URL.Host, tcpDialTimeout)
+	if err != nil {
+		logger.Error("TCPProxy", "Backend dial error", "service", svc.Name, "backend", b.URL.Host, "error", err)
+		TCPConnectionErrorsTotal.WithLabelValues(svc.Name, "dial").Inc()
+		return
+	}
+	if !p.track(upstream) {
+		upstream.Close()
+		return
+	}
+	defer p.untrack(upstream)
+
+	// Tell the backend who the real client is.
+	if version := p.sendProxy.Load().(string); version != "" {
+		if _, err := upstream.Write(proxyHeader(version, client.RemoteAddr(), client.LocalAddr())); err != nil {
+			logger.Error("TCPProxy", "Error sending PROXY protocol header", "service", svc.Name, "backend", b.URL.Host, "error", err)
+			TCPConnectionErrorsTotal.WithLabelValues(svc.Name, "proxy_header").Inc()
+			return
+		}
+	}
+
+	b.IncConn()
+	ActiveConnections.WithLabelValues(svc.Name, b.URL.String()).Inc()
+	TCPActiveConnections.WithLabelValues(svc.Name).Inc()
+	TCPConnectionsTotal.WithLabelValues(svc.Name, b.URL.String()).Inc()
+	defer func() {
+		b.DecConn()
+		ActiveConnections.WithLabelValues(svc.Name, b.URL.String()).Dec()
+		TCPActiveConnections.WithLabelValues(svc.Name).Dec()
+	}()
+
+	idle := time.Duration(p.idleTimeout.Load())
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		n := relay(upstream, client, idle, &lastActive)
+		TCPBytesTotal.WithLabelValues(svc.Name, "client_to_backend").Add(float64(n))
+	}()
+	go func() {
+		defer wg.Done()
+		n := relay(client, upstream, idle, &lastActive)
+		TCPBytesTotal.WithLabelValues(svc.Name, "backend_to_client").Add(float64(n))
+	}()
+	wg.Wait()
+}
+
+// relay copies src to dst until src is exhausted, then half-closes dst so the other
+// direction can finish. The connection counts as idle only when neither direction
+// saw traffic for the idle timeout; in that case both sides are closed.
+func relay(dst, src net.Conn, idle time.Duration, lastActive *atomic.Int64) int64 {
+	var total int64
+	buf := make([]byte, 32*1024)
+	for {
+		if idle > 0 {
+			src.SetReadDeadline(time.Now().Add(idle))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			lastActive.Store(time.Now().UnixNano())
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				src.Close()
+				return total
+			}
+			total += int64(n)
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if time.Since(time.Unix(0, lastActive.Load())) < idle {
+					continue // The other direction is still busy.
+				}
+				src.Close()
+				dst.Close()
+				return total
+			}
+			if err == io.EOF {
+				if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+					return total
+				}
+			}
+			dst.Close()
+			return total
+		}
+	}
+}
+
+// track registers an open connection, so Close can interrupt it. It returns false
+// once the proxy is closing.
+func (p *TCPProxy) track(c net.Conn) bool {
+	p.connsMux.Lock()
+	defer p.connsMux.Unlock()
+	if p.conns == nil {
+		return false
+	}
+	p.conns[c] = struct{}{}
+	return true
+}
+
+func (p *TCPProxy) untrack(c net.Conn) {
+	p.connsMux.Lock()
+	delete(p.conns, c)
+	p.connsMux.Unlock()
+	c.Close()
+}
+
+// Close stops accepting connections and waits for the open ones to finish until
+// ctx expires, after which they are closed. Health checks stop with the listener.
+func (p *TCPProxy) Close(ctx context.Context) {
+	p.listener.Close()
+	p.service.Load().Stop()
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		p.connsMux.Lock()
+		for c := range p.conns {
+			c.Close()
+		}
+		p.conns = nil
+		p.connsMux.Unlock()
+		<-done
+	}
+}
+
+// closeRemoved closes the proxy of a TCP service removed from the config, giving its
+// connections tcpRemovedTimeout to finish in the background. The listener is closed
+// before it returns, so its address can be bound again at once.
+func (p *TCPProxy) closeRemoved() {
+	p.listener.Close()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tcpRemovedTimeout)
+		defer cancel()
+		p.Close(ctx)
+	}()
+}
+
+// tcpHealthChecker only connects to backends.
+type tcpHealthChecker struct {
+	healthTarget
+}
+
+// alive reports whether a connection to the backend can be opened.
+func (hc *tcpHealthChecker) alive(b *Backend) bool {
+	network, address := hc.address(b)
+	conn, err := net.DialTimeout(network, address, hc.timeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
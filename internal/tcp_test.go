@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+func TestTCPProxyCloseStopsHealthChecks(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	p, err := newTCPProxy(config.TCPServiceType{Name: "db", Listen: "127.0.0.1:0", Backends: []string{backend.Addr().String()}}, &adminStates{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.start()
+	client, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("x")) // Wait for the relay to start.
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	closed := make(chan struct{})
+	go func() {
+		p.Close(ctx)
+		close(closed)
+	}()
+	// The open connection holds up Close, but not the end of the health checks.
+	select {
+	case <-p.service.Load().stop:
+	case <-time.After(time.Second):
+		t.Error("health checks still running after the listener closed")
+	}
+	select {
+	case <-closed:
+		t.Fatal("Close returned with a connection open")
+	default:
+	}
+
+	cancel()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not close the connections when its context expired")
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("client connection still open after Close")
+	}
+}
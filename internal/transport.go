@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+	"github.com/vinit-chauhan/load-balancer/logger"
+)
+
+// Defaults of the backend transports, which match http.DefaultTransport.
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultMaxIdleConns        = 100
+)
+
+// Request phases a timeout can fire in, used as the "phase" metric label.
+const (
+	timeoutPhaseDial           = "dial"
+	timeoutPhaseTLSHandshake   = "tls_handshake"
+	timeoutPhaseResponseHeader = "response_header"
+	timeoutPhaseRequest        = "request"
+)
+
+// parseTimeout parses a timeout setting, returning def when it is not set.
+// Settings are checked by Validate, so invalid values also fall back to def.
+func parseTimeout(setting string, def time.Duration) time.Duration {
+	if setting == "" {
+		return def
+	}
+	d, err := time.ParseDuration(setting)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// newTransport builds the transport the backend u of the service is reached through,
+// with the timeouts and connection pool settings of the service. Unix socket backends
+// are dialed at socketPath, whatever the address of the request.
+//
+// Each backend gets its own transport, so the pool only ever holds connections to
+// one host: unlike http.DefaultTransport, which keeps 2 idle connections per host,
+// all the idle connections of the pool may go to that host.
+func newTransport(serviceConf config.ServiceType, u *url.URL, socketPath string) *http.Transport {
+	timeouts, pool := serviceConf.Timeouts, serviceConf.ConnectionPool
+	dialer := &net.Dialer{
+		Timeout:   parseTimeout(timeouts.Dial, defaultDialTimeout),
+		KeepAlive: parseTimeout(pool.KeepAlive, defaultKeepAlive),
+	}
+	network, address := "", ""
+	if socketPath != "" {
+		network, address = "unix", socketPath
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = func(ctx context.Context, netw, addr string) (net.Conn, error) {
+		BackendDialsTotal.WithLabelValues(serviceConf.Name, u.String()).Inc()
+		if network != "" {
+			netw, addr = network, address
+		}
+		return dialer.DialContext(ctx, netw, addr)
+	}
+	t.TLSHandshakeTimeout = parseTimeout(timeouts.TLSHandshake, defaultTLSHandshakeTimeout)
+	t.ResponseHeaderTimeout = parseTimeout(timeouts.ResponseHeader, 0)
+	t.IdleConnTimeout = parseTimeout(timeouts.IdleConn, defaultIdleConnTimeout)
+
+	t.MaxIdleConns = defaultMaxIdleConns
+	if pool.MaxIdleConns > 0 {
+		t.MaxIdleConns = pool.MaxIdleConns
+	}
+	t.MaxIdleConnsPerHost = t.MaxIdleConns
+	t.MaxConnsPerHost = pool.MaxConnsPerHost
+	t.DisableKeepAlives = pool.DisableKeepAlives
+	t.DisableCompression = pool.DisableCompression
+
+	if serviceConf.Protocol == "grpc" {
+		useGrpcProtocols(t)
+	}
+	return t
+}
+
+// poolTrace records whether the requests sent to a backend reuse a pooled connection.
+func (b *Backend) poolTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			total := b.pooledConns.Add(1)
+			reused := b.reusedConns.Load()
+			if info.Reused {
+				reused = b.reusedConns.Add(1)
+			}
+			BackendConnectionsTotal.WithLabelValues(b.ServiceName, b.URL.String(), strconv.FormatBool(info.Reused)).Inc()
+			BackendConnectionReuseRatio.WithLabelValues(b.ServiceName, b.URL.String()).Set(float64(reused) / float64(total))
+		},
+	}
+}
+
+// newErrorHandler returns the ReverseProxy error handler of a backend. Timeouts are
+// answered with 504 and counted by phase, other errors with 502. gRPC services
+// answer with the matching gRPC status instead.
+func newErrorHandler(serviceConf config.ServiceType, u *url.URL) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, e error) {
+		logger.ErrorContext(r.Context(), "Proxy error", "backend", u.String(), "error", e.Error())
+
+		phase, timedOut := timeoutPhase(e)
+		if timedOut {
+			UpstreamTimeoutsTotal.WithLabelValues(serviceConf.Name, u.String(), phase).Inc()
+		}
+
+		switch {
+		case serviceConf.Protocol == "grpc" && timedOut:
+			writeGrpcError(w, grpcDeadlineExceeded, "upstream timeout")
+		case serviceConf.Protocol == "grpc":
+			writeGrpcError(w, grpcUnavailable, "upstream unavailable")
+		case timedOut:
+			w.WriteHeader(http.StatusGatewayTimeout)
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
+}
+
+// timeoutPhase reports whether a proxy error is a timeout, and in which phase of
+// the request it fired.
+func timeoutPhase(err error) (string, bool) {
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout():
+		return timeoutPhaseDial, true
+	case strings.Contains(err.Error(), "TLS handshake timeout"):
+		return timeoutPhaseTLSHandshake, true
+	case strings.Contains(err.Error(), "timeout awaiting response headers"):
+		return timeoutPhaseResponseHeader, true
+	case errors.Is(err, context.DeadlineExceeded):
+		return timeoutPhaseRequest, true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return timeoutPhaseRequest, true
+	}
+	return "", false
+}
@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+	"github.com/vinit-chauhan/load-balancer/logger"
+)
+
+const (
+	udpDefaultSessionTimeout = 30 * time.Second
+	udpMaxDatagramSize       = 64 * 1024
+)
+
+// UDPProxy forwards datagrams received on a listener to the backends of a UDP service.
+//
+// Each client address gets a session bound to one backend, chosen by the service
+// algorithm when its first datagram arrives. As the listener address and protocol
+// are fixed, the client address identifies the whole 5-tuple of the flow. Replies
+// from the backend are sent back to the client from the listener address.
+type UDPProxy struct {
+	Listen         string
+	service        atomic.Pointer[Service]
+	sessionTimeout atomic.Int64          // time.Duration
+	conf           config.UDPServiceType // As last applied, owned by config changes.
+	conn           net.PacketConn
+	sessions       map[string]*udpSession // Keyed by client address.
+	sessionsMux    sync.Mutex
+	done           chan struct{}
+	wg             sync.WaitGroup
+}
+
+// udpSession is a client flow pinned to a backend.
+type udpSession struct {
+	client     net.Addr
+	backend    *Backend
+	service    string
+	upstream   *net.UDPConn // Connected to the backend, so only its replies are received.
+	lastActive atomic.Int64
+}
+
+// newUDPService builds the Service used to pick backends for a UDP service.
+func newUDPService(serviceConf config.UDPServiceType) *Service {
+	serviceConf.Validate() // Validate service configuration
+	backends := make([]*Backend, 0, len(serviceConf.Backends))
+	for _, backendURL := range serviceConf.Backends {
+		if !strings.Contains(backendURL, "://") {
+			backendURL = "udp://" + backendURL
+		}
+		u, err := url.Parse(backendURL)
+		if err != nil || u.Port() == "" {
+			logger.Error("newUDPService", "error parsing backend address", "url", backendURL, "error", err)
+			continue
+		}
+		backends = append(backends, &Backend{
+			URL:         u,
+			ServiceName: serviceConf.Name,
+			Alive:       true,
+		})
+	}
+
+	svc := &Service{
+		Name:      serviceConf.Name,
+		Backends:  backends,
+		Algorithm: serviceConf.Algorithm,
+		Protocol:  "udp",
+		stop:      make(chan struct{}),
+	}
+	svc.UpdateHashRing()
+	return svc
+}
+
+// newUDPProxy binds the socket of a UDP service, served once the proxy is started.
+func newUDPProxy(serviceConf config.UDPServiceType, admin *adminStates) (*UDPProxy, error) {
+	conn, err := net.ListenPacket("udp", serviceConf.Listen)
+	if err != nil {
+		return nil, err
+	}
+	p := &UDPProxy{
+		Listen:   serviceConf.Listen,
+		conn:     conn,
+		sessions: make(map[string]*udpSession),
+		done:     make(chan struct{}),
+	}
+	p.update(serviceConf, admin)
+	return p, nil
+}
+
+// start serves the datagrams received by the proxy.
+func (p *UDPProxy) start() {
+	p.wg.Add(2)
+	go p.serve()
+	go p.expireSessions()
+	logger.Info("UDPProxy", "Listening for UDP service", "service", p.conf.Name, "listen", p.Listen)
+}
+
+// update replaces the service behind the proxy. Existing sessions keep their backend
+// until they expire.
+func (p *UDPProxy) update(serviceConf config.UDPServiceType, admin *adminStates) {
+	timeout, err := time.ParseDuration(serviceConf.SessionTimeout)
+	if err != nil || timeout <= 0 {
+		timeout = udpDefaultSessionTimeout
+	}
+	p.sessionTimeout.Store(int64(timeout))
+	p.conf = serviceConf
+	svc := newUDPService(serviceConf)
+	admin.apply(svc)
+	if old := p.service.Swap(svc); old != nil {
+		old.Stop()
+	}
+}
+
+func (p *UDPProxy) serve() {
+	defer p.wg.Done()
+	buf := make([]byte, udpMaxDatagramSize)
+	for {
+		n, addr, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Error("UDPProxy", "Read error", "listen", p.Listen, "error", err)
+			continue
+		}
+
+		sess, reason := p.session(addr)
+		if sess == nil {
+			UDPDroppedDatagramsTotal.WithLabelValues(p.service.Load().Name, reason).Inc()
+			continue
+		}
+		sess.lastActive.Store(time.Now().UnixNano())
+		if _, err := sess.upstream.Write(buf[:n]); err != nil {
+			UDPDroppedDatagramsTotal.WithLabelValues(sess.service, "backend_write").Inc()
+			continue
+		}
+		UDPDatagramsTotal.WithLabelValues(sess.service, "client_to_backend").Inc()
+	}
+}
+
+// session returns the session of the client, creating it if needed. When no session
+// can be created, it returns the reason the datagram is dropped.
+func (p *UDPProxy) session(addr net.Addr) (*udpSession, string) {
+	key := addr.String()
+	p.sessionsMux.Lock()
+	defer p.sessionsMux.Unlock()
+	if p.sessions == nil {
+		return nil, "closed" // The proxy is shutting down.
+	}
+	if sess, ok := p.sessions[key]; ok {
+		return sess, ""
+	}
+
+	svc := p.service.Load()
+	b := svc.GetNextBackendForAddr(key)
+	if b == nil {
+		return nil, "no_backend"
+	}
+	raddr, err := net.ResolveUDPAddr("udp", b.URL.Host)
+	if err != nil {
+		logger.Error("UDPProxy", "Backend resolve error", "service", svc.Name, "backend", b.URL.Host, "error", err)
+		return nil, "backend_dial"
+	}
+	upstream, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		logger.Error("UDPProxy", "Backend dial error", "service", svc.Name, "backend", b.URL.Host, "error", err)
+		return nil, "backend_dial"
+	}
+
+	sess := &udpSession{client: addr, backend: b, service: svc.Name, upstream: upstream}
+	p.sessions[key] = sess
+	b.IncConn()
+	ActiveConnections.WithLabelValues(svc.Name, b.URL.String()).Inc()
+	UDPSessions.WithLabelValues(svc.Name).Inc()
+
+	p.wg.Add(1)
+	go p.replies(sess)
+	return sess, ""
+}
+
+// replies sends the datagrams of the backend back to the client, until the session
+// is closed.
+func (p *UDPProxy) replies(sess *udpSession) {
+	defer p.wg.Done()
+	buf := make([]byte, udpMaxDatagramSize)
+	for {
+		n, err := sess.upstream.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// e.g. ICMP port unreachable: the backend may come back, keep the session.
+			UDPDroppedDatagramsTotal.WithLabelValues(sess.service, "backend_read").Inc()
+			continue
+		}
+		sess.lastActive.Store(time.Now().UnixNano())
+		if _, err := p.conn.WriteTo(buf[:n], sess.client); err != nil {
+			UDPDroppedDatagramsTotal.WithLabelValues(sess.service, "client_write").Inc()
+			continue
+		}
+		UDPDatagramsTotal.WithLabelValues(sess.service, "backend_to_client").Inc()
+	}
+}
+
+// expireSessions periodically closes the sessions that have been idle for longer
+// than the session timeout.
+func (p *UDPProxy) expireSessions() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			timeout := time.Duration(p.sessionTimeout.Load())
+			p.sessionsMux.Lock()
+			for key, sess := range p.sessions {
+				if time.Since(time.Unix(0, sess.lastActive.Load())) >= timeout {
+					delete(p.sessions, key)
+					sess.close()
+				}
+			}
+			p.sessionsMux.Unlock()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (sess *udpSession) close() {
+	sess.upstream.Close()
+	sess.backend.DecConn()
+	ActiveConnections.WithLabelValues(sess.service, sess.backend.URL.String()).Dec()
+	UDPSessions.WithLabelValues(sess.service).Dec()
+}
+
+// Close stops the listener and drops all sessions.
+func (p *UDPProxy) Close() {
+	close(p.done)
+	p.conn.Close()
+	p.sessionsMux.Lock()
+	for _, sess := range p.sessions {
+		sess.close()
+	}
+	p.sessions = nil
+	p.sessionsMux.Unlock()
+	p.wg.Wait()
+	p.service.Load().Stop()
+}
+
+// closeRemoved closes the proxy of a UDP service removed from the config, in the
+// background. The socket is closed before it returns, so its address can be bound
+// again at once.
+func (p *UDPProxy) closeRemoved() {
+	p.conn.Close()
+	go p.Close()
+}
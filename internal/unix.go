@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// unixHost is the host used in requests sent over a Unix socket, where there is no
+// host to address. Clients' Host headers are still forwarded as they are.
+const unixHost = "localhost"
+
+// isUnixBackend reports whether a backend URL points to a Unix socket.
+func isUnixBackend(raw string) bool {
+	return strings.HasPrefix(raw, "unix://")
+}
+
+// parseUnixBackend splits a Unix socket backend URL such as "unix:///run/app.sock" or
+// "unix:///run/app.sock:/api" into the socket path and the URL requests are proxied
+// to, which carries the optional HTTP path prefix that follows the colon.
+func parseUnixBackend(raw string) (string, *url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", nil, err
+	}
+	if u.Host != "" || u.Path == "" {
+		return "", nil, fmt.Errorf("unix backend must be an absolute socket path, e.g. unix:///run/app.sock")
+	}
+	socketPath, prefix, _ := strings.Cut(u.Path, ":")
+	return socketPath, &url.URL{Scheme: "http", Host: unixHost, Path: prefix}, nil
+}
+
+// ListenUnix listens on the Unix socket at path, removing a stale socket file left
+// behind by a previous run.
+func ListenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+// upstreamKey is the context key of the upstreamRequest a request to a backend belongs to.
+type upstreamKey struct{}
+
+// upstreamRequest is what the transport of the first backend picked for a request
+// needs to send it to other backends of the service too, when it is hedged or retried.
+type upstreamRequest struct {
+	service *Service
+	primary *Backend
+	inbound *http.Request // The request as received, before the first backend rewrote its URL.
+	hedge   bool          // The request may be hedged.
+	retry   bool          // The request may be retried.
+	// Set once the transport told the circuit breaker of the first backend how its
+	// attempt ended: it failed before another backend was tried, or it lost a hedge.
+	primaryRecorded bool
+	hedgeAnswered   *Backend // Backend of the hedge whose response or error was returned, recorded.
+}
+
+// withUpstream lets the transport of the backend hedge or retry r, when the service
+// does that and r is safe to send more than once: it has no body, and is no stream.
+func (s *Service) withUpstream(r *http.Request, primary *Backend) (*http.Request, *upstreamRequest) {
+	if (r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0) || acceptsEventStream(r) || isUpgradeRequest(r) {
+		return r, nil
+	}
+	ur := &upstreamRequest{
+		service: s,
+		primary: primary,
+		inbound: r.Clone(r.Context()),
+		hedge:   s.hedger != nil && r.Method == http.MethodGet,
+		retry:   s.retrier != nil && isIdempotent(r.Method),
+	}
+	if !ur.hedge && !ur.retry {
+		return r, nil
+	}
+	if ur.hedge {
+		s.hedger.earn()
+	}
+	return r.WithContext(context.WithValue(r.Context(), upstreamKey{}, ur)), ur
+}
+
+// isIdempotent reports whether requests with the method may be repeated safely.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// upstreamTransport is the transport of the backends of services that hedge or retry
+// requests. Other requests, like health checks, go straight to the backend.
+type upstreamTransport struct {
+	base *http.Transport
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ur, _ := req.Context().Value(upstreamKey{}).(*upstreamRequest)
+	if ur == nil {
+		return t.base.RoundTrip(req)
+	}
+	return ur.roundTrip(t.base, req)
+}
+
+// send sends the request to the first backend, hedging it when allowed.
+func (ur *upstreamRequest) send(base http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if ur.hedge {
+		return ur.hedgedRoundTrip(base, req)
+	}
+	return base.RoundTrip(req)
+}
+
+// retarget copies the request sent to the first backend for backend b, picked by
+// Service.acquireOther: the headers set by the proxy are kept, and the URL is rewritten from
+// the inbound one by b. The returned func cancels the copy and gives back its slot.
+func (ur *upstreamRequest) retarget(req *http.Request, b *Backend) (*http.Request, func()) {
+	// The inbound context, unlike the one of req, does not count the connection in
+	// the pool stats of the first backend.
+	ctx, cancel := context.WithCancel(ur.inbound.Context())
+	ctx = httptrace.WithClientTrace(ctx, b.poolTrace())
+	r := req.Clone(ctx)
+	u := *ur.inbound.URL
+	r.URL = &u
+	b.ReverseProxy.Director(r)
+	return r, sync.OnceFunc(func() {
+		cancel()
+		ur.service.releaseBackend(b)
+	})
+}
+
+// releasingBody releases the attempt that produced a response once its body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,420 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/logger"
+)
+
+// wsCloseGrace is how long peers get to answer our close frames before the sockets are dropped.
+const wsCloseGrace = 5 * time.Second
+
+// WebSocket close codes sent by the load balancer.
+const (
+	wsCloseGoingAway = 1001
+)
+
+// Reasons an upgraded connection was closed, used as the "reason" metric label.
+const (
+	upgradeClosedPeer     = "peer"
+	upgradeClosedIdle     = "idle"
+	upgradeClosedLifetime = "lifetime"
+	upgradeClosedShutdown = "shutdown"
+	upgradeClosedDrain    = "drain"
+)
+
+// hopHeaders are the hop-by-hop headers that must not be forwarded to the backend.
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// upgradeLimits bounds the lifetime of the upgraded connections of a service.
+type upgradeLimits struct {
+	idleTimeout time.Duration // Close the connection after this long without traffic (0 = no limit).
+	maxLifetime time.Duration // Close the connection after this long regardless of traffic (0 = no limit).
+}
+
+// upgradedConn is a client connection that was switched to another protocol
+// (typically WebSocket) and is tunnelled to a backend.
+type upgradedConn struct {
+	backend     *Backend
+	client      net.Conn
+	upstream    net.Conn
+	websocket   bool       // Whether frames are parsed, so close frames can be sent on shutdown.
+	clientMux   sync.Mutex // Serializes writes to the client so close frames never split a frame.
+	upstreamMux sync.Mutex // Serializes writes to the backend.
+	lastActive  atomic.Int64
+	closing     atomic.Bool  // Set once our close frames are on their way.
+	replies     atomic.Int32 // Close frames still expected from the peers.
+	closeReason atomic.Value
+	closeOnce   sync.Once
+	teardown    sync.Once
+	done        chan struct{}
+}
+
+// isUpgradeRequest reports whether the client asked to switch protocols.
+func isUpgradeRequest(r *http.Request) bool {
+	if r.ProtoMajor != 1 || r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dialBackend opens a raw connection to the backend through the dialer of its
+// transport, using TLS for https/wss backends.
+func (b *Backend) dialBackend(ctx context.Context) (net.Conn, error) {
+	t := b.transport
+	secure := b.URL.Scheme == "https" || b.URL.Scheme == "wss"
+	host := b.URL.Host
+	if b.URL.Port() == "" {
+		if secure {
+			host = net.JoinHostPort(b.URL.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(b.URL.Hostname(), "80")
+		}
+	}
+	conn, err := t.DialContext(ctx, "tcp", host)
+	if err != nil || !secure {
+		return conn, err
+	}
+
+	cfg := &tls.Config{ServerName: b.URL.Hostname()}
+	if t.TLSClientConfig != nil {
+		cfg = t.TLSClientConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = b.URL.Hostname()
+		}
+	}
+	tlsConn := tls.Client(conn, cfg)
+	hsCtx, cancel := context.WithTimeout(ctx, t.TLSHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(hsCtx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// serveUpgrade performs the protocol switch with the backend and, once both sides
+// agreed, tunnels the hijacked client connection to it. It returns as soon as the
+// handshake is done; the tunnel keeps running in the background until a side
+// closes it or one of the limits fires.
+//
+// Upgraded connections are tracked separately from ActiveConns, because their long
+// lifetime would otherwise make least-connections avoid backends that are idle.
+func (b *Backend) serveUpgrade(rw *responseWriter, r *http.Request, limits upgradeLimits) {
+	ctx := r.Context()
+	outreq := r.Clone(ctx)
+	b.ReverseProxy.Director(outreq)
+	upgrade := r.Header.Get("Upgrade")
+	for _, h := range hopHeaders {
+		outreq.Header.Del(h)
+	}
+	outreq.Header.Set("Connection", "Upgrade")
+	outreq.Header.Set("Upgrade", upgrade)
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		outreq.Header.Set("X-Forwarded-For", ip)
+	}
+
+	upstream, err := b.dialBackend(ctx)
+	if err != nil {
+		logger.ErrorContext(ctx, "Upgrade dial error", "backend", b.URL.String(), "error", err.Error())
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	upstreamBuf := bufio.NewReader(upstream)
+	res, err := func() (*http.Response, error) {
+		if err := outreq.Write(upstream); err != nil {
+			return nil, err
+		}
+		return http.ReadResponse(upstreamBuf, outreq)
+	}()
+	if err != nil {
+		upstream.Close()
+		logger.ErrorContext(ctx, "Upgrade handshake error", "backend", b.URL.String(), "error", err.Error())
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		// The backend refused the upgrade; relay its answer as a regular response.
+		defer upstream.Close()
+		defer res.Body.Close()
+		for k, vv := range res.Header {
+			for _, v := range vv {
+				rw.Header().Add(k, v)
+			}
+		}
+		rw.WriteHeader(res.StatusCode)
+		io.Copy(rw, res.Body)
+		return
+	}
+
+	client, clientBuf, err := http.NewResponseController(rw).Hijack()
+	if err != nil {
+		upstream.Close()
+		logger.ErrorContext(ctx, "Upgrade hijack error", "backend", b.URL.String(), "error", err.Error())
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// The deadlines of the listener's read and write timeouts stay on hijacked
+	// connections. They count from the upgrade request, so clear them, leaving
+	// upgraded connections to the idle and lifetime limits.
+	client.SetDeadline(time.Time{})
+	rw.statusCode = http.StatusSwitchingProtocols
+	if err := res.Write(clientBuf); err == nil {
+		err = clientBuf.Flush()
+	}
+	if err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+
+	c := &upgradedConn{
+		backend:   b,
+		client:    client,
+		upstream:  upstream,
+		websocket: strings.EqualFold(upgrade, "websocket"),
+		done:      make(chan struct{}),
+	}
+	c.touch()
+	b.addUpgrade(c)
+	go c.pipe(c.client, &c.clientMux, upstreamBuf)
+	go c.pipe(c.upstream, &c.upstreamMux, clientBuf.Reader)
+	c.watch(limits)
+}
+
+func (c *upgradedConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// watch arms the idle and max-lifetime limits of the connection.
+func (c *upgradedConn) watch(limits upgradeLimits) {
+	if limits.maxLifetime > 0 {
+		t := time.AfterFunc(limits.maxLifetime, func() { c.Close(upgradeClosedLifetime) })
+		go func() { <-c.done; t.Stop() }()
+	}
+	if limits.idleTimeout > 0 {
+		var t *time.Timer
+		t = time.AfterFunc(limits.idleTimeout, func() {
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+			idle := time.Since(time.Unix(0, c.lastActive.Load()))
+			if idle >= limits.idleTimeout {
+				c.Close(upgradeClosedIdle)
+				return
+			}
+			t.Reset(limits.idleTimeout - idle)
+		})
+		go func() { <-c.done; t.Stop() }()
+	}
+}
+
+// pipe copies src to dst and drops the connection when the copy ends, unless it
+// ended because the peer answered our close frame and the other peer still has to.
+func (c *upgradedConn) pipe(dst net.Conn, dstMux *sync.Mutex, src io.Reader) {
+	if c.copyStream(dst, dstMux, src) && c.replies.Add(-1) > 0 {
+		return
+	}
+	c.close()
+}
+
+// copyStream copies src to dst until either side fails. WebSocket traffic is copied
+// frame by frame while holding dstMux, so a close frame can be injected between
+// frames. It reports whether the copy ended on the peer's answer to our close frame.
+func (c *upgradedConn) copyStream(dst net.Conn, dstMux *sync.Mutex, src io.Reader) bool {
+	if !c.websocket {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				c.touch()
+				dstMux.Lock()
+				_, werr := dst.Write(buf[:n])
+				dstMux.Unlock()
+				if werr != nil {
+					return false
+				}
+			}
+			if err != nil {
+				return false
+			}
+		}
+	}
+
+	var header [14]byte
+	for {
+		if _, err := io.ReadFull(src, header[:2]); err != nil {
+			return false
+		}
+		c.touch()
+		n := 2
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			if _, err := io.ReadFull(src, header[2:4]); err != nil {
+				return false
+			}
+			length = uint64(binary.BigEndian.Uint16(header[2:4]))
+			n = 4
+		case 127:
+			if _, err := io.ReadFull(src, header[2:10]); err != nil {
+				return false
+			}
+			length = binary.BigEndian.Uint64(header[2:10])
+			n = 10
+		}
+		if header[1]&0x80 != 0 {
+			if _, err := io.ReadFull(src, header[n:n+4]); err != nil {
+				return false
+			}
+			n += 4
+		}
+		opcode := header[0] & 0x0f
+
+		if c.closing.Load() {
+			// We already sent our close frames: swallow the traffic still in flight
+			// and stop once the peer answered with its own close frame.
+			if _, err := io.CopyN(io.Discard, src, int64(length)); err != nil {
+				return false
+			}
+			if opcode == 0x8 {
+				return true
+			}
+			continue
+		}
+
+		dstMux.Lock()
+		_, err := dst.Write(header[:n])
+		if err == nil {
+			_, err = io.CopyN(dst, src, int64(length))
+		}
+		dstMux.Unlock()
+		if err != nil {
+			return false
+		}
+		c.touch()
+	}
+}
+
+// Close ends the connection gracefully: WebSocket peers receive a "going away"
+// close frame and get wsCloseGrace to answer before the sockets are dropped.
+func (c *upgradedConn) Close(reason string) {
+	c.closeOnce.Do(func() {
+		c.closeReason.Store(reason)
+		if !c.websocket {
+			c.close()
+			return
+		}
+		c.replies.Store(2)
+		c.closing.Store(true)
+		go writeCloseFrame(c.client, &c.clientMux, false)
+		go writeCloseFrame(c.upstream, &c.upstreamMux, true)
+		t := time.AfterFunc(wsCloseGrace, c.close)
+		go func() { <-c.done; t.Stop() }()
+	})
+}
+
+// close drops both sockets and releases the connection slot.
+func (c *upgradedConn) close() {
+	c.teardown.Do(func() {
+		c.client.Close()
+		c.upstream.Close()
+		reason, _ := c.closeReason.Load().(string)
+		if reason == "" {
+			reason = upgradeClosedPeer
+		}
+		c.backend.removeUpgrade(c, reason)
+		close(c.done)
+	})
+}
+
+// writeCloseFrame sends a "going away" close frame. Frames sent to the backend
+// act as a client and must therefore be masked.
+func writeCloseFrame(conn net.Conn, mux *sync.Mutex, masked bool) {
+	payload := binary.BigEndian.AppendUint16(nil, wsCloseGoingAway)
+	frame := []byte{0x88, byte(len(payload))}
+	if masked {
+		var key [4]byte // An all-zero key is valid and leaves the payload unchanged.
+		frame[1] |= 0x80
+		frame = append(frame, key[:]...)
+	}
+	frame = append(frame, payload...)
+
+	mux.Lock()
+	defer mux.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(wsCloseGrace))
+	conn.Write(frame)
+}
+
+func (b *Backend) addUpgrade(c *upgradedConn) {
+	b.upgradeMux.Lock()
+	if b.upgrades == nil {
+		b.upgrades = make(map[*upgradedConn]struct{})
+	}
+	b.upgrades[c] = struct{}{}
+	b.upgradeMux.Unlock()
+	UpgradedConnections.WithLabelValues(b.ServiceName, b.URL.String()).Inc()
+}
+
+func (b *Backend) removeUpgrade(c *upgradedConn, reason string) {
+	b.upgradeMux.Lock()
+	delete(b.upgrades, c)
+	b.upgradeMux.Unlock()
+	UpgradedConnections.WithLabelValues(b.ServiceName, b.URL.String()).Dec()
+	UpgradedConnectionsClosedTotal.WithLabelValues(b.ServiceName, b.URL.String(), reason).Inc()
+}
+
+// GetActiveUpgrades returns the number of upgraded connections currently tunnelled to the backend.
+func (b *Backend) GetActiveUpgrades() int {
+	b.upgradeMux.Lock()
+	defer b.upgradeMux.Unlock()
+	return len(b.upgrades)
+}
+
+// CloseUpgrades gracefully closes every upgraded connection of the backend and
+// waits until they are gone or ctx expires.
+func (b *Backend) CloseUpgrades(ctx context.Context, reason string) {
+	b.upgradeMux.Lock()
+	conns := make([]*upgradedConn, 0, len(b.upgrades))
+	for c := range b.upgrades {
+		conns = append(conns, c)
+	}
+	b.upgradeMux.Unlock()
+
+	for _, c := range conns {
+		c.Close(reason)
+	}
+	for _, c := range conns {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vinit-chauhan/load-balancer/config"
+)
+
+// newEchoBackend starts a backend echoing what it gets once upgraded.
+func newEchoBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// dialUpgrade opens a connection upgraded by the server at addr.
+func dialUpgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: lb\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade response = %v, %v; want 101", res, err)
+	}
+	return conn, reader
+}
+
+func TestUpgradeOutlivesServerTimeouts(t *testing.T) {
+	s := newTestService(t, config.ServiceType{Backends: []string{newEchoBackend(t).URL}})
+	front := httptest.NewUnstartedServer(s)
+	front.Config.ReadTimeout = 100 * time.Millisecond
+	front.Config.WriteTimeout = 100 * time.Millisecond
+	front.Start()
+	defer front.Close()
+
+	conn, reader := dialUpgrade(t, front.Listener.Addr().String())
+	time.Sleep(300 * time.Millisecond) // Past both server timeouts.
+	io.WriteString(conn, "ping")
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(reader, got); err != nil || string(got) != "ping" {
+		t.Errorf("echo after the server timeouts = %q, %v; want ping", got, err)
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
@@ -63,69 +65,148 @@ func main() {
 	internal.InitMetrics()
 	handler.Handle("/metrics", promhttp.Handler())
 
-	for _, serviceConf := range conf.Services {
-		path := serviceConf.UrlPath
-		if path == "" {
-			logger.Panic("main", "Service URL path cannot be empty")
+	// Services are looked up per request, so services added by config reloads or the
+	// admin API are routed too.
+	handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		svc := loadBalancer.MatchService(r.URL.Path)
+		if svc == nil {
+			// Like http.ServeMux, send "/path" to the service at "/path/".
+			if loadBalancer.GetServices(r.URL.Path+"/") != nil {
+				u := *r.URL
+				u.Path += "/"
+				http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+				return
+			}
+			http.NotFound(w, r)
+			return
 		}
 
-		// Closure to capture service
-		svc := loadBalancer.GetServices(path)
-		
-		handler.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-			// Start Trace Span
-			ctx := r.Context()
-			tr := otel.Tracer("load-balancer")
-			ctx, span := tr.Start(ctx, "proxy_request")
-			defer span.End()
-
-			// Add attributes
-			span.SetAttributes(attribute.String("http.path", r.URL.Path))
-			span.SetAttributes(attribute.String("service.name", svc.Name))
-
-			// Inject trace context into headers for backend
-			otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
-			
-			// Pass context with span
-			r = r.WithContext(ctx)
-
-			logger.DebugContext(ctx, "Forwarding request", "tag", "Proxy", "path", r.URL.Path, "service", svc.Name)
-			
-			svc.ServeHTTP(w, r)
-		})
-	}
+		// Start Trace Span
+		ctx := r.Context()
+		tr := otel.Tracer("load-balancer")
+		ctx, span := tr.Start(ctx, "proxy_request")
+		defer span.End()
+
+		// Add attributes
+		span.SetAttributes(attribute.String("http.path", r.URL.Path))
+		span.SetAttributes(attribute.String("service.name", svc.Name))
+
+		// Inject trace context into headers for backend
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
+
+		// Pass context with span
+		r = r.WithContext(ctx)
+
+		logger.DebugContext(ctx, "Forwarding request", "tag", "Proxy", "path", r.URL.Path, "service", svc.Name)
+
+		svc.ServeHTTP(w, r)
+	})
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
+	// Accept cleartext HTTP/2 (h2c) next to HTTP/1.1, which gRPC clients need.
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+
 	server := &http.Server{
-		Addr:    "0.0.0.0:" + port,
-		Handler: handler,
+		Addr:              "0.0.0.0:" + port,
+		Handler:           handler,
+		Protocols:         protocols,
+		ReadTimeout:       parseDuration("read_timeout", conf.Listener.ReadTimeout),
+		ReadHeaderTimeout: parseDuration("read_header_timeout", conf.Listener.ReadHeaderTimeout),
+		WriteTimeout:      parseDuration("write_timeout", conf.Listener.WriteTimeout),
+		IdleTimeout:       parseDuration("idle_timeout", conf.Listener.IdleTimeout),
 	}
 
 	// Graceful Shutdown
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
+	var ln net.Listener
+	var err error
+	if conf.Listener.UnixSocket != "" {
+		server.Addr = conf.Listener.UnixSocket
+		ln, err = internal.ListenUnix(server.Addr)
+	} else {
+		ln, err = net.Listen("tcp", server.Addr)
+	}
+	if err != nil {
+		logger.Panic("main", "Failed to listen", "addr", server.Addr, "error", err)
+	}
+	// Behind a load balancer speaking PROXY protocol, recover the real client address.
+	ln, err = internal.NewProxyProtoListener(ln, conf.Listener.ProxyProtocol)
+	if err != nil {
+		logger.Panic("main", "Invalid PROXY protocol configuration", "error", err)
+	}
+
 	go func() {
-		logger.Info("main", "Starting reverse proxy with multiple backends on 0.0.0.0:"+port+"...")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Info("main", "Starting reverse proxy with multiple backends on "+server.Addr+"...")
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
 			logger.Panic("main", "Server failed", "error", err)
 		}
 	}()
 
+	// The admin API listens apart from the traffic, on localhost by default.
+	var adminServer *http.Server
+	conf.Admin.Validate()
+	if conf.Admin.Enabled {
+		var save internal.Saver
+		if conf.Admin.Persist {
+			save = config.File(configPath)
+		}
+		adminServer = &http.Server{
+			Addr: conf.Admin.Listen,
+			Handler: internal.NewAdminHandler(loadBalancer, conf.Admin.Token, func() error {
+				return reloadConfig(loadBalancer)
+			}, save),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			logger.Info("main", "Starting admin API on "+adminServer.Addr+"...")
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Panic("main", "Admin API failed", "error", err)
+			}
+		}()
+	}
+
 	<-stop
 	logger.Info("main", "Shutting down the server...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
+	if adminServer != nil {
+		adminServer.Shutdown(ctx)
+	}
+
 	if err := server.Shutdown(ctx); err != nil {
 		logger.Error("main", "Server shutdown failed", "error", err)
 	} else {
 		logger.Info("main", "Server stopped gracefully")
 	}
+
+	// Hijacked connections are not covered by server.Shutdown.
+	loadBalancer.CloseUpgradedConns(ctx)
+	logger.Info("main", "Upgraded connections closed")
+
+	loadBalancer.StopTCPProxies(ctx)
+	loadBalancer.StopUDPProxies()
+	logger.Info("main", "TCP and UDP services stopped")
+}
+
+// parseDuration parses a duration setting of the listener, where empty means zero.
+func parseDuration(name, value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logger.Panic("main", "Invalid listener setting", "setting", name, "value", value, "error", err)
+	}
+	return d
 }
 
 // watchConfig watches the config file for changes and reloads the configuration.
@@ -136,7 +217,9 @@ func watchConfig(loadBalancer *internal.LoadBalancer) {
 	}
 	defer watcher.Close()
 
-	err = watcher.Add(configPath)
+	// Watch the directory, as editors and config.Save replace the file rather than
+	// write it, which would end a watch of the file itself.
+	err = watcher.Add(filepath.Dir(configPath))
 	if err != nil {
 		logger.Panic("watchConfig", "Failed to add config file to watcher", "path", configPath, "error", err)
 	}
@@ -147,13 +230,20 @@ func watchConfig(loadBalancer *internal.LoadBalancer) {
 			if !ok {
 				return
 			}
+			if filepath.Clean(event.Name) != filepath.Clean(configPath) {
+				continue
+			}
 			// We only care about Write or Create events
 			if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
+				// Skip the writes of the admin API, and of editors saving an unchanged file.
+				if !config.Modified(configPath) {
+					continue
+				}
 				logger.Info("watchConfig", "Config file modified, reloading...", "path", event.Name)
-				// Reload the configuration
-				config.Load(configPath)
-				newConf := config.GetConfig()
-				loadBalancer.UpdateServices(&newConf)
+				if err := reloadConfig(loadBalancer); err != nil {
+					logger.Error("watchConfig", "Config reload failed, keeping the current config", "error", err)
+					continue
+				}
 				logger.Info("watchConfig", "Config reloaded successfully")
 			}
 		case err, ok := <-watcher.Errors:
@@ -164,3 +254,11 @@ func watchConfig(loadBalancer *internal.LoadBalancer) {
 		}
 	}
 }
+
+// reloadConfig loads the config file again and applies it. A config file that cannot be
+// read or is invalid is reported, rather than taking the load balancer down.
+func reloadConfig(loadBalancer *internal.LoadBalancer) error {
+	return loadBalancer.ReloadConfig(func() (config.ConfigType, error) {
+		return config.Reload(configPath)
+	}, config.Set)
+}